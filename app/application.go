@@ -3,20 +3,22 @@ package app
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"path"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"fyne.io/systray"
 	"git.blackforestbytes.com/BlackForestBytes/goext/dataext"
 	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
-	"git.blackforestbytes.com/BlackForestBytes/goext/mathext"
 	"git.blackforestbytes.com/BlackForestBytes/goext/syncext"
 	"git.blackforestbytes.com/BlackForestBytes/goext/termext"
 	"git.blackforestbytes.com/BlackForestBytes/goext/timeext"
+	"github.com/shirou/gopsutil/v3/process"
 	"mikescher.com/kpsync/assets"
 )
 
@@ -28,33 +30,69 @@ type Application struct {
 	logList        []LogMessage
 	logBroadcaster *dataext.PubSub[string, LogMessage]
 
-	config Config
+	jsonLogFile    *os.File        // JSON-lines log (config.log_json), if set
+	jsonLogBacklog []jsonLogRecord // messages logged before the config was loaded
+	jsonLogDecided bool            // config was loaded, no more backlog is collected
+
+	config         atomic.Pointer[Config] // the current config, replaced as a whole on reload (use cfg())
+	configPath     string                 // explicit config file (-config / KPSYNC_CONFIG), replaces the user config files
+	configFlags    []configOverride       // explicitly set command line flags, applied on top of the config files
+	configSources  map[string]string      // config key -> where the value came from (default, file, env, flag)
+	configFiles    []string               // config files that were read
+	configProblems []ConfigProblem        // problems found while loading the config
+	configLenient  bool                   // don't abort on an invalid config (`kpsync config ...`, `doctor`, `ctl`)
 
 	trayReady       *syncext.AtomicBool
 	uploadWaiting   *syncext.AtomicBool
 	uploadActive    *syncext.AtomicBool
 	syncLoopRunning *syncext.AtomicBool
 	keepassRunning  *syncext.AtomicBool
+	syncReady       *syncext.AtomicBool // initial sync finished, app.dbFile is the synced database
+	syncPaused      *syncext.AtomicBool // file changes are not uploaded (paused via control socket)
+
+	debugUnsafe bool // --debug-unsafe: secrets are not redacted in the log
+
+	headless bool // no desktop session (e.g. `kpsync exec`) - notifications are only logged, questions count as dismissed
+
+	fastStartPending bool // keepassxc was started on the cached database, the remote check is still outstanding
+	uploadOnStart    bool // the attached keepassxc has un-synced changes, they are uploaded instead of downloading the remote database
 
 	fileWatcherIgnore []dataext.Tuple[time.Time, string]
 
 	sigKPExitChan     chan bool  // keepass exited
 	sigManualStopChan chan bool  // manual stop
+	sigQuitChan       chan bool  // quit requested by the user (tray)
 	sigErrChan        chan error // fatal error
 
 	sigSyncLoopStopChan chan bool // stop sync loop
+	sigResidentStopChan chan bool // stop resident pull loop
+	sigConfigStopChan   chan bool // stop config file watcher
 	sigTermKeepassChan  chan bool // stop keepass
 
-	dbFile    string
-	stateFile string
+	dbFile           string
+	stateFile        string
+	partialFile      string // in-progress download of dbFile
+	partialStateFile string
+	skippedFile      string // marker: the upload of the local changes was skipped (size anomaly), they must not be overwritten
+
+	attachedKeepass    *process.Process   // already running keepassxc that has dbFile open
+	preexistingKeepass []*process.Process // already running keepassxc instances (with other databases)
+	keepassPID         int                // PID of the keepassxc we started / are tracking (0 if none)
+
+	lockFile *os.File // {work_dir}/kpsync.lock, flock'ed while we are running
 
 	currSysTrayTooltip string
 
-	uploadDCI *dataext.DelayedCombiningInvoker
+	uploadDCI       *uploadInvoker
+	uploadPostpones int // uploads postponed in a row because the database file did not become stable (see postponeUnstableUpload)
+
+	controlListener net.Listener // control socket (`kpsync ctl`)
 
 	trayItemChecksum     *systray.MenuItem
 	trayItemETag         *systray.MenuItem
 	trayItemLastModified *systray.MenuItem
+	trayItemOpenKeepass  *systray.MenuItem
+	trayItemRestartHint  *systray.MenuItem
 }
 
 func NewApplication() *Application {
@@ -63,17 +101,23 @@ func NewApplication() *Application {
 		masterLock:          sync.Mutex{},
 		logLock:             sync.Mutex{},
 		logList:             make([]LogMessage, 0, 1024),
+		jsonLogBacklog:      make([]jsonLogRecord, 0, 128),
 		logBroadcaster:      dataext.NewPubSub[string, LogMessage](128),
 		uploadWaiting:       syncext.NewAtomicBool(false),
 		uploadActive:        syncext.NewAtomicBool(false),
 		trayReady:           syncext.NewAtomicBool(false),
 		syncLoopRunning:     syncext.NewAtomicBool(false),
 		keepassRunning:      syncext.NewAtomicBool(false),
+		syncReady:           syncext.NewAtomicBool(false),
+		syncPaused:          syncext.NewAtomicBool(false),
 		fileWatcherIgnore:   make([]dataext.Tuple[time.Time, string], 0, 128),
 		sigKPExitChan:       make(chan bool, 128),
 		sigManualStopChan:   make(chan bool, 128),
+		sigQuitChan:         make(chan bool, 128),
 		sigErrChan:          make(chan error, 128),
 		sigSyncLoopStopChan: make(chan bool, 128),
+		sigResidentStopChan: make(chan bool, 128),
+		sigConfigStopChan:   make(chan bool, 128),
 		sigTermKeepassChan:  make(chan bool, 128),
 	}
 
@@ -87,49 +131,78 @@ func NewApplication() *Application {
 }
 
 func (app *Application) Run() {
-	var configPath string
 	var err error
 
-	app.config, configPath = app.loadConfig()
+	configPath := app.loadConfig(os.Args[1:])
 
 	app.LogInfo(fmt.Sprintf("Loaded config from %s", configPath))
-	app.LogDebug(fmt.Sprintf("WebDAVURL     := '%s'", app.config.WebDAVURL))
-	app.LogDebug(fmt.Sprintf("WebDAVUser    := '%s'", app.config.WebDAVUser))
-	app.LogDebug(fmt.Sprintf("WebDAVPass    := '%s'", app.config.WebDAVPass))
-	app.LogDebug(fmt.Sprintf("LocalFallback := '%s'", langext.Coalesce(app.config.LocalFallback, "<null>")))
-	app.LogDebug(fmt.Sprintf("WorkDir       := '%s'", app.config.WorkDir))
-	app.LogDebug(fmt.Sprintf("Debounce      := %d ms", app.config.Debounce))
-	app.LogDebug(fmt.Sprintf("ForceColors   := %v", app.config.ForceColors))
+	app.LogDebug(fmt.Sprintf("WebDAVURL     := '%s'", app.cfg().WebDAVURL))
+	app.LogDebug(fmt.Sprintf("WebDAVUser    := '%s'", app.cfg().WebDAVUser))
+	if app.cfg().WebDAVPass != "" {
+		app.LogDebug("WebDAVPass    := <set>")
+	} else {
+		app.LogDebug("WebDAVPass    := <not set>")
+	}
+	app.LogDebug(fmt.Sprintf("LocalFallback := '%s'", langext.Coalesce(app.cfg().LocalFallback, "<null>")))
+	app.LogDebug(fmt.Sprintf("WorkDir       := '%s'", app.cfg().WorkDir))
+	app.LogDebug(fmt.Sprintf("Debounce      := %d ms", app.cfg().Debounce))
+	app.LogDebug(fmt.Sprintf("ForceColors   := %v", app.cfg().ForceColors))
+	app.LogDebug(fmt.Sprintf("ShrinkThresh. := %d %%", app.cfg().ShrinkThreshold))
+	app.LogDebug(fmt.Sprintf("MinSize       := %d bytes", app.cfg().MinSize))
+	app.LogDebug(fmt.Sprintf("WatchMode     := %s", app.cfg().WatchMode))
+	app.LogDebug(fmt.Sprintf("PollInterval  := %d ms", app.cfg().PollInterval))
+	app.LogDebug(fmt.Sprintf("NoLaunch      := %v", app.cfg().NoLaunch))
+	app.LogDebug(fmt.Sprintf("ShutdownGrace := %d ms", app.cfg().ShutdownGrace))
+	app.LogDebug(fmt.Sprintf("FastStart     := %v", app.cfg().FastStart))
+	app.LogDebug(fmt.Sprintf("Resident      := %v (pull every %d ms)", app.cfg().Resident, app.cfg().ResidentPullInterval))
+	app.LogDebug(fmt.Sprintf("NotifySuccess := %v", app.cfg().NotifySuccess))
+	app.LogDebug(fmt.Sprintf("LogLevel      := %s", app.cfg().LogLevel))
+	app.LogDebug(fmt.Sprintf("LogJSON       := '%s'", app.cfg().LogJSON))
 	app.LogLine()
 
-	app.logFile, err = os.OpenFile(path.Join(app.config.WorkDir, "kpsync.log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	// must happen before the log file is opened (O_TRUNC) - the log belongs to the running instance
+	if ownerPID, err := app.acquireInstanceLock(); errors.Is(err, InstanceLockedError) {
+		app.handleRunningInstance(ownerPID)
+		return
+	} else if err != nil {
+		app.LogFatalErr("Failed to acquire instance lock", err)
+	}
+	defer app.releaseInstanceLock()
+
+	app.logFile, err = os.OpenFile(path.Join(app.cfg().WorkDir, "kpsync.log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		app.LogFatalErr("Failed to open log file", err)
 	}
+	if err := app.logFile.Chmod(0600); err != nil { // log files of older versions were created with 0644
+		app.LogError("Failed to set permissions of log file", err)
+	}
 	defer func() {
 		if err := app.logFile.Close(); err != nil {
 			app.fallbackLog("Failed to close log file: " + err.Error())
 		}
 	}()
 	app.writeOutStartupLogs()
+	defer app.closeJSONLog()
 
 	go func() { app.initTray() }()
 
-	if app.config.LocalFallback != nil {
-		if _, err := os.Stat(*app.config.LocalFallback); errors.Is(err, os.ErrNotExist) {
+	if app.cfg().LocalFallback != nil {
+		if _, err := os.Stat(*app.cfg().LocalFallback); errors.Is(err, os.ErrNotExist) {
 
-			app.LogError(fmt.Sprintf("Configured local-fallback '%s' not found - disabling.", *app.config.LocalFallback), nil)
-			app.showErrorNotification("Local fallback database not found", fmt.Sprintf("Configured local-fallback '%s' not found - fallback option won't be available.", *app.config.LocalFallback))
+			app.LogError(fmt.Sprintf("Configured local-fallback '%s' not found - disabling.", *app.cfg().LocalFallback), nil)
+			app.showErrorNotification("Local fallback database not found", fmt.Sprintf("Configured local-fallback '%s' not found - fallback option won't be available.", *app.cfg().LocalFallback))
 
-			app.config.LocalFallback = nil
+			cfg := *app.cfg()
+			cfg.LocalFallback = nil
+			app.setConfig(cfg)
 		}
 	}
 
-	debounce := timeext.FromMilliseconds(app.config.Debounce)
-	app.uploadDCI = dataext.NewDelayedCombiningInvoker(app.runDBUpload, debounce, mathext.Max(45*time.Second, debounce*3))
+	app.uploadDCI = app.newUploadDCI()
 
-	app.uploadDCI.RegisterOnRequest(func(_ int, _ bool) { app.uploadWaiting.Set(app.uploadDCI.HasPendingRequests()) })
-	app.uploadDCI.RegisterOnExecutionDone(func() { app.uploadWaiting.Set(app.uploadDCI.HasPendingRequests()) })
+	app.startControlSocket()
+
+	go func() { app.runConfigWatcher() }()
 
 	go func() {
 		app.syncLoopRunning.Set(true)
@@ -146,14 +219,41 @@ func (app *Application) Run() {
 			return
 		} else if isr == InitSyncResponseOkay {
 
-			go func() {
-				app.keepassRunning.Set(true)
-				defer app.keepassRunning.Set(false)
+			app.syncReady.Set(true)
 
-				app.runKeepass(false)
-			}()
+			if app.cfg().NoLaunch {
+
+				app.LogInfo("Daemon mode - not starting keepassxc (stop with SIGTERM or via tray)")
+				app.LogLine()
+
+			} else {
+
+				go func() {
+					app.keepassRunning.Set(true)
+					defer app.keepassRunning.Set(false)
+
+					if app.attachedKeepass != nil {
+						app.trackKeepassProcess(app.attachedKeepass)
+					} else {
+						app.runKeepass(false)
+					}
+				}()
+
+				time.Sleep(1 * time.Second)
+
+			}
 
-			time.Sleep(1 * time.Second)
+			if app.fastStartPending {
+				go func() { app.runFastStartCheck() }()
+			}
+
+			if app.uploadOnStart {
+				app.uploadDCI.Request()
+			}
+
+			if app.cfg().Resident && !app.cfg().NoLaunch {
+				go func() { app.runResidentPullLoop() }()
+			}
 
 			app.setTrayStateDirect("Sleeping...", assets.IconDefault)
 
@@ -163,10 +263,16 @@ func (app *Application) Run() {
 				return
 			}
 
-		} else if isr == InitSyncResponseFallback && app.config.LocalFallback != nil {
+		} else if isr == InitSyncResponseFallback && app.cfg().NoLaunch {
+
+			app.LogError("Remote database not available - nothing to sync in daemon mode", nil)
+			app.sigManualStopChan <- true
+			return
+
+		} else if isr == InitSyncResponseFallback && app.cfg().LocalFallback != nil {
 
 			app.LogInfo(fmt.Sprintf("Starting KeepassXC with local fallback database (without sync loop!)"))
-			app.LogDebug(fmt.Sprintf("DB-Path := '%s'", *app.config.LocalFallback))
+			app.LogDebug(fmt.Sprintf("DB-Path := '%s'", *app.cfg().LocalFallback))
 
 			go func() {
 				app.keepassRunning.Set(true)
@@ -188,51 +294,105 @@ func (app *Application) Run() {
 	sigTerm := make(chan os.Signal, 1)
 	signal.Notify(sigTerm, os.Interrupt, syscall.SIGTERM)
 
-	select {
-	case <-sigTerm: // kpsync received SIGTERM
+	sigUser := make(chan os.Signal, 8)
+	signal.Notify(sigUser, syscall.SIGUSR1, syscall.SIGUSR2)
 
-		app.LogInfo("Stopping application (received SIGTERM signal)")
+	for {
+		select {
+		case <-sigTerm: // kpsync received SIGTERM
 
-		app.stopBackgroundRoutines()
+			app.LogInfo("Stopping application (received SIGTERM signal)")
 
-		app.runFinalSync()
+			app.stopBackgroundRoutines()
 
-		return
+			if app.syncReady.Get() {
+				app.runFinalSync()
+			}
 
-	case err := <-app.sigErrChan: // fatal error
+			return
 
-		app.LogInfo("Stopping application (received ERROR)")
+		case sig := <-sigUser: // signal from a second instance
 
-		app.stopBackgroundRoutines()
+			if sig == syscall.SIGUSR1 {
+				app.LogInfo("Received SIGUSR1 - syncing now")
+				if app.syncReady.Get() {
+					go func() { app.runExplicitSync(false) }()
+				}
+			} else {
+				app.LogInfo("Received SIGUSR2 - showing keepassxc")
+				go func() { app.showKeepass() }()
+			}
 
-		app.LogError("Stopped due to error: "+err.Error(), nil)
+		case err := <-app.sigErrChan: // fatal error
 
-		return
+			app.LogInfo("Stopping application (received ERROR)")
 
-	case <-app.sigManualStopChan: // manual
+			app.stopBackgroundRoutines()
 
-		app.LogInfo("Stopping application (manual)")
+			app.LogError("Stopped due to error: "+err.Error(), nil)
 
-		app.stopBackgroundRoutines()
+			return
 
-		return
+		case <-app.sigManualStopChan: // manual
 
-	case _ = <-app.sigKPExitChan: // keepass exited
+			app.LogInfo("Stopping application (manual)")
 
-		app.LogInfo("Stopping application (received STOP)")
+			app.stopBackgroundRoutines()
 
-		app.stopBackgroundRoutines()
+			return
 
-		app.runFinalSync()
+		case <-app.sigQuitChan: // quit (tray)
 
-		return
+			app.LogInfo("Stopping application (quit)")
+
+			app.stopBackgroundRoutines()
+
+			if app.syncReady.Get() {
+				app.runFinalSync()
+			}
+
+			return
+
+		case _ = <-app.sigKPExitChan: // keepass exited
 
+			if app.cfg().Resident && app.syncReady.Get() {
+				app.LogInfo("keepassxc exited - staying in tray (resident mode)")
+				app.LogLine()
+
+				app.runFinalSync()
+
+				app.setTrayOpenKeepassEnabled(true)
+				continue
+			}
+
+			app.LogInfo("Stopping application (received STOP)")
+
+			app.stopBackgroundRoutines()
+
+			if app.syncReady.Get() {
+				app.runFinalSync()
+			}
+
+			return
+
+		}
 	}
 }
 
+// newUploadDCI creates the (debounced) invoker for runDBUpload with the configured debounce
+func (app *Application) newUploadDCI() *uploadInvoker {
+	return newUploadInvoker(app.runDBUpload, timeext.FromMilliseconds(app.cfg().Debounce), func(pending bool) { app.uploadWaiting.Set(pending) })
+}
+
 func (app *Application) stopBackgroundRoutines() {
 	app.LogInfo("Stopping go-routines...")
 
+	app.LogDebug("Stopping control socket...")
+	app.stopControlSocket()
+	app.LogDebug("Stopped control socket.")
+
+	app.sigConfigStopChan <- true
+
 	app.LogDebug("Stopping systray...")
 	systray.Quit()
 	app.trayReady.Wait(false)
@@ -249,6 +409,8 @@ func (app *Application) stopBackgroundRoutines() {
 		app.LogInfo("Upload finished.")
 	}
 
+	app.sigResidentStopChan <- true
+
 	app.LogDebug("Stopping sync-loop...")
 	app.sigSyncLoopStopChan <- true
 	app.syncLoopRunning.Wait(false)
@@ -0,0 +1,398 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/cryptext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
+)
+
+// exit codes of the one-shot commands (status, pull, push, verify)
+const (
+	CmdExitOK    = 0 // in sync / success
+	CmdExitDrift = 1 // not in sync, or the operation was refused (conflict, local changes, ...)
+	CmdExitError = 2 // the operation failed
+)
+
+type DriftType string //@enum:type
+
+const (
+	DriftLocalMissing  DriftType = "LOCAL_MISSING"  // no database in the work dir
+	DriftLocalInvalid  DriftType = "LOCAL_INVALID"  // the database in the work dir is no valid KDBX file
+	DriftLocalModified DriftType = "LOCAL_MODIFIED" // local database differs from kpsync.state (un-synced local changes)
+	DriftStateMissing  DriftType = "STATE_MISSING"  // no (readable) kpsync.state
+	DriftStateSize     DriftType = "STATE_SIZE"     // size in kpsync.state does not match the local database
+	DriftRemoteChanged DriftType = "REMOTE_CHANGED" // remote ETag differs from kpsync.state (un-synced remote changes)
+)
+
+type SyncReport struct {
+	Command string       `json:"command"`
+	DBFile  string       `json:"db_file"`
+	Local   *LocalInfo   `json:"local"`
+	Cached  *CachedState `json:"cached"`
+	Remote  *RemoteInfo  `json:"remote"`
+	InSync  bool         `json:"in_sync"`
+	Drift   []DriftEntry `json:"drift"`
+	Result  string       `json:"result,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+type LocalInfo struct {
+	Checksum        string    `json:"checksum"`
+	Size            int64     `json:"size"`
+	ModTime         time.Time `json:"mod_time"`
+	ValidationError string    `json:"validation_error,omitempty"`
+}
+
+// CachedState is kpsync.state as it is reported by status, verify and `ctl status` (the state file keeps its own format)
+type CachedState struct {
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	Checksum     string    `json:"checksum"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func newCachedState(state *State) *CachedState {
+	if state == nil {
+		return nil
+	}
+	return &CachedState{ETag: state.ETag, Size: state.Size, Checksum: state.Checksum, LastModified: state.LastModified}
+}
+
+type RemoteInfo struct {
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type DriftEntry struct {
+	Type        DriftType `json:"type"`
+	Description string    `json:"description"`
+}
+
+// RunStatus implements `kpsync status [--json]`: compares the local database, kpsync.state and the remote ETag
+func (app *Application) RunStatus(args []string) int {
+	return app.runReportCommand("status", args, false)
+}
+
+// RunVerify implements `kpsync verify [--json]`: like status, but explains every difference
+func (app *Application) RunVerify(args []string) int {
+	return app.runReportCommand("verify", args, true)
+}
+
+// runReportCommand collects and prints the sync report (status / verify), returns the exit code
+func (app *Application) runReportCommand(command string, args []string, explain bool) int {
+	jsonOutput := flag.Bool("json", false, "Print the result as JSON")
+
+	report, code := func() (*SyncReport, int) {
+		if err := app.initCommand(args); err != nil {
+			return app.errorReport(command, err), CmdExitError
+		}
+
+		report, err := app.collectReport(command)
+		if err != nil {
+			app.LogError("Failed to query remote database", err)
+			report.Error = err.Error()
+			return report, CmdExitError
+		}
+
+		if !report.InSync {
+			return report, CmdExitDrift
+		}
+		return report, CmdExitOK
+	}()
+
+	app.printReport(report, *jsonOutput, explain)
+	return code
+}
+
+// RunPull implements `kpsync pull [--force] [--json]`: downloads the remote database into the work dir.
+// Refuses to overwrite un-synced local changes (or a local database without kpsync.state) unless --force is set.
+func (app *Application) RunPull(args []string) int {
+	jsonOutput := flag.Bool("json", false, "Print the result as JSON")
+	force := flag.Bool("force", false, "Overwrite un-synced local changes")
+
+	result, code := func() (string, int) {
+		if err := app.initCommand(args); err != nil {
+			return "", CmdExitError
+		}
+
+		if pid, err := app.acquireInstanceLock(); err != nil {
+			app.LogError(fmt.Sprintf("Work dir is in use by another kpsync instance (PID %d) - use `kpsync ctl` instead", pid), err)
+			return "", CmdExitError
+		}
+		defer app.releaseInstanceLock()
+
+		op := app.beginOperation("pull")
+		defer op.End()
+
+		state := app.readState()
+
+		if state == nil && fileExists(app.dbFile) && !*force {
+			op.LogError("No state file - can't tell if the local database has un-synced changes, refusing to overwrite it (use --force)", nil)
+			return "refused", CmdExitDrift
+		}
+
+		var etagIfNoneMatch *string = nil
+		if state != nil && fileExists(app.dbFile) {
+			localCS, err := app.calcLocalChecksum()
+			if err != nil {
+				op.LogError("Failed to calculate local database checksum", err)
+				return "", CmdExitError
+			}
+			if localCS != state.Checksum && !*force {
+				op.LogError("Local database has un-synced changes - refusing to overwrite them (use --force)", nil)
+				return "refused", CmdExitDrift
+			}
+			if localCS == state.Checksum && !*force {
+				etagIfNoneMatch = langext.Ptr(state.ETag)
+			}
+		}
+
+		etag, lm, sha, sz, err := app.downloadDatabase(op, etagIfNoneMatch)
+		if errors.Is(err, NotModifiedError) {
+			op.LogInfo("Local database is up-to-date with remote")
+			return "up-to-date", CmdExitOK
+		}
+		if err != nil {
+			op.LogError("Failed to download remote database", err)
+			return "", CmdExitError
+		}
+
+		op.LogInfo(fmt.Sprintf("Downloaded remote database to %s", app.dbFile))
+
+		err = app.saveState(etag, lm, sha, sz)
+		if err != nil {
+			op.LogError("Failed to save state", err)
+			return "", CmdExitError
+		}
+
+		return "downloaded", CmdExitOK
+	}()
+
+	app.finishOperation("pull", result, code, *jsonOutput)
+	return code
+}
+
+// RunPush implements `kpsync push [--force] [--json]`: uploads the local database (conditional on the cached ETag).
+// With --force the remote file is overwritten unconditionally.
+func (app *Application) RunPush(args []string) int {
+	jsonOutput := flag.Bool("json", false, "Print the result as JSON")
+	force := flag.Bool("force", false, "Overwrite the remote database, even if it was modified")
+
+	result, code := func() (string, int) {
+		if err := app.initCommand(args); err != nil {
+			return "", CmdExitError
+		}
+
+		if pid, err := app.acquireInstanceLock(); err != nil {
+			app.LogError(fmt.Sprintf("Work dir is in use by another kpsync instance (PID %d) - use `kpsync ctl` instead", pid), err)
+			return "", CmdExitError
+		}
+		defer app.releaseInstanceLock()
+
+		op := app.beginOperation("push")
+		defer op.End()
+
+		if !fileExists(app.dbFile) {
+			op.LogError(fmt.Sprintf("No local database found at '%s'", app.dbFile), nil)
+			return "", CmdExitError
+		}
+
+		state := app.readState()
+
+		localCS, err := app.calcLocalChecksum()
+		if err != nil {
+			op.LogError("Failed to calculate local database checksum", err)
+			return "", CmdExitError
+		}
+
+		if state != nil && localCS == state.Checksum && !*force {
+			op.LogInfo("Local database still matches remote (via checksum) - no need to upload")
+			return "up-to-date", CmdExitOK
+		}
+
+		if state == nil && !*force {
+			op.LogError("No state file - can't upload conditionally (use --force to overwrite the remote database)", nil)
+			return "refused", CmdExitDrift
+		}
+
+		if *force {
+			op.LogWarn("Forced push - overwriting remote database")
+			err = app.doDBUpload(op, nil, func() {}, false)
+		} else {
+			if !app.checkUploadSizeAnomaly(op, state) {
+				return "refused", CmdExitDrift
+			}
+			err = app.doDBUpload(op, state, func() {}, false)
+		}
+
+		if errors.Is(err, ETagConflictError) {
+			return "conflict", CmdExitDrift
+		}
+		if err != nil {
+			return "", CmdExitError
+		}
+
+		return "uploaded", CmdExitOK
+	}()
+
+	app.finishOperation("push", result, code, *jsonOutput)
+	return code
+}
+
+// initCommand loads the config (and the flags in args) for a one-shot command
+func (app *Application) initCommand(args []string) error {
+	app.headless = true
+
+	configPath := app.loadConfig(args)
+
+	app.LogDebug(fmt.Sprintf("Loaded config from %s", configPath))
+
+	err := app.initPaths()
+	if err != nil {
+		app.LogError("Failed to initialize work directory", err)
+		return exerr.Wrap(err, "").Build()
+	}
+
+	return nil
+}
+
+// finishOperation prints the result of pull/push together with the (new) sync status
+func (app *Application) finishOperation(command string, result string, code int, jsonOutput bool) {
+	report := &SyncReport{Command: command, DBFile: app.dbFile, Drift: make([]DriftEntry, 0)}
+
+	if app.stateFile != "" {
+		r, err := app.collectReport(command)
+		if err != nil {
+			app.LogError("Failed to query remote database", err)
+		}
+		report = r
+	}
+
+	report.Result = result
+	if code == CmdExitError {
+		report.Result = "error"
+		report.Error = "operation failed (see log)"
+	}
+
+	app.printReport(report, jsonOutput, false)
+}
+
+func (app *Application) errorReport(command string, err error) *SyncReport {
+	return &SyncReport{Command: command, DBFile: app.dbFile, Drift: make([]DriftEntry, 0), Error: err.Error()}
+}
+
+// collectReport compares the local database, kpsync.state and the remote database (HEAD).
+// The report is always returned, err is only set if the remote could not be queried.
+func (app *Application) collectReport(command string) (*SyncReport, error) {
+	op := app.beginOperation("status")
+	defer op.End()
+
+	report := &SyncReport{Command: command, DBFile: app.dbFile, Drift: make([]DriftEntry, 0)}
+
+	addDrift := func(t DriftType, desc string) {
+		report.Drift = append(report.Drift, DriftEntry{Type: t, Description: desc})
+	}
+
+	if bin, err := os.ReadFile(app.dbFile); err == nil {
+		report.Local = &LocalInfo{Checksum: cryptext.BytesSha256(bin), Size: int64(len(bin))}
+		if fi, err := os.Stat(app.dbFile); err == nil {
+			report.Local.ModTime = fi.ModTime()
+		}
+		if verr := validateKDBX(bin); verr != nil {
+			report.Local.ValidationError = verr.Error()
+			addDrift(DriftLocalInvalid, "The local database is not a valid KeePass database: "+verr.Error())
+		}
+	} else {
+		addDrift(DriftLocalMissing, fmt.Sprintf("There is no local database at '%s'", app.dbFile))
+	}
+
+	report.Cached = newCachedState(app.readState())
+	if report.Cached == nil {
+		addDrift(DriftStateMissing, fmt.Sprintf("There is no (readable) state file at '%s'", app.stateFile))
+	}
+
+	if report.Local != nil && report.Cached != nil {
+		if report.Local.Checksum != report.Cached.Checksum {
+			addDrift(DriftLocalModified, fmt.Sprintf("The local database was modified since the last sync (checksum %s, last synced %s)", langext.StrLimit(report.Local.Checksum, 16, ""), langext.StrLimit(report.Cached.Checksum, 16, "")))
+		} else if report.Cached.Size > 0 && report.Local.Size != report.Cached.Size {
+			addDrift(DriftStateSize, fmt.Sprintf("The size in the state file (%d) does not match the local database (%d)", report.Cached.Size, report.Local.Size))
+		}
+	}
+
+	etag, lm, err := app.getRemoteState(op)
+	if err != nil {
+		report.InSync = false
+		return report, exerr.Wrap(err, "").Build()
+	}
+
+	report.Remote = &RemoteInfo{ETag: etag, LastModified: lm}
+
+	if report.Cached != nil && report.Cached.ETag != etag {
+		addDrift(DriftRemoteChanged, fmt.Sprintf("The remote database was modified since the last sync (ETag %s, last synced %s)", etag, report.Cached.ETag))
+	}
+
+	report.InSync = len(report.Drift) == 0
+
+	return report, nil
+}
+
+func (app *Application) printReport(report *SyncReport, jsonOutput bool, explain bool) {
+	if jsonOutput {
+		bin, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			app.LogError("Failed to marshal report", err)
+			return
+		}
+		fmt.Println(string(bin))
+		return
+	}
+
+	if report.Result != "" {
+		fmt.Printf("Result:          %s\n", report.Result)
+	}
+
+	fmt.Printf("Database:        %s\n", report.DBFile)
+
+	if report.Local != nil {
+		fmt.Printf("Local checksum:  %s (%s)\n", report.Local.Checksum, langext.FormatBytes(report.Local.Size))
+	} else {
+		fmt.Printf("Local checksum:  -\n")
+	}
+
+	if report.Cached != nil {
+		fmt.Printf("Cached checksum: %s (%s)\n", report.Cached.Checksum, langext.FormatBytes(report.Cached.Size))
+		fmt.Printf("Cached ETag:     %s (%s)\n", report.Cached.ETag, report.Cached.LastModified.Format(time.RFC3339))
+	} else {
+		fmt.Printf("Cached checksum: -\n")
+		fmt.Printf("Cached ETag:     -\n")
+	}
+
+	if report.Remote != nil {
+		fmt.Printf("Remote ETag:     %s (%s)\n", report.Remote.ETag, report.Remote.LastModified.Format(time.RFC3339))
+	} else {
+		fmt.Printf("Remote ETag:     - (unreachable)\n")
+	}
+
+	if report.Error != "" {
+		fmt.Printf("Error:           %s\n", report.Error)
+	} else if report.InSync {
+		fmt.Printf("Status:          in sync\n")
+	} else {
+		fmt.Printf("Status:          NOT in sync\n")
+	}
+
+	for _, d := range report.Drift {
+		if explain {
+			fmt.Printf("  - [%s] %s\n", d.Type, d.Description)
+		} else {
+			fmt.Printf("  - %s\n", d.Type)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package app
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"os"
-	"os/user"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
 
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
 	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
 )
 
@@ -24,110 +30,538 @@ type Config struct {
 	TerminalEmulator string `json:"terminal_emulator"`
 
 	Debounce int `json:"debounce"`
+
+	ShrinkThreshold int   `json:"shrink_threshold"` // ask before uploading a file that shrunk by more than this (in percent, 0 = disabled)
+	MinSize         int64 `json:"min_size"`         // ask before uploading a file smaller than this (in bytes, 0 = disabled)
+
+	WatchMode    string `json:"watch_mode"`    // auto | inotify | poll
+	PollInterval int    `json:"poll_interval"` // (in ms) only used with watch_mode=poll
+
+	Launcher *LauncherConfig `json:"launcher"` // how to start the password-manager (default: `keepassxc {db}`)
+	Unlock   *UnlockConfig   `json:"unlock"`   // key file / master password passed to keepassxc at launch
+
+	NoLaunch bool `json:"no_launch"` // daemon mode - only sync the work-dir file, don't start keepassxc
+
+	ShutdownGrace int `json:"shutdown_grace"` // (in ms) how long to wait for keepassxc to quit before sending SIGTERM
+
+	FastStart bool `json:"fast_start"` // start keepassxc on the cached database and check the remote in the background
+
+	Resident             bool `json:"resident"`               // keep running in the tray after keepassxc exits
+	ResidentPullInterval int  `json:"resident_pull_interval"` // (in ms) how often to check for remote changes while resident and keepassxc is closed
+
+	NotifySuccess bool   `json:"notify_success"` // show a notification after every successful sync (errors and questions are always shown)
+	LogLevel      string `json:"log_level"`      // debug | info | warn | error
+	LogJSON       string `json:"log_json"`       // additionally write the log as JSON-lines to this file (empty = disabled)
+}
+
+// configKey describes one (top-level) key of the config and where it can be set
+type configKey struct {
+	Name     string              // key in the config file, the env var is KPSYNC_{NAME}
+	Flags    []string            // names of the command line flags (none for nested objects)
+	Usage    string              // flag description
+	Secret   bool                // value is redacted in `kpsync config show`
+	Secrets  []string            // fields of a nested object that are redacted in `kpsync config show` (the values of a map individually)
+	Live     bool                // a changed value is applied while running (otherwise kpsync must be restarted)
+	OnLaunch bool                // (with Live) the value is only read when keepassxc is started, a change affects the next start
+	Field    func(c *Config) any // pointer to the field in the Config struct
+}
+
+var configKeys = []configKey{
+	{Name: "webdav_url", Flags: []string{"webdav_url"}, Usage: "WebDAV URL", Field: func(c *Config) any { return &c.WebDAVURL }},
+	{Name: "webdav_user", Live: true, Flags: []string{"webdav_user"}, Usage: "WebDAV User", Field: func(c *Config) any { return &c.WebDAVUser }},
+	{Name: "webdav_pass", Live: true, Flags: []string{"webdav_pass"}, Usage: "WebDAV Password", Secret: true, Field: func(c *Config) any { return &c.WebDAVPass }},
+	{Name: "local_fallback", Flags: []string{"local_fallback"}, Usage: "Local fallback database", Field: func(c *Config) any { return &c.LocalFallback }},
+	{Name: "work_dir", Flags: []string{"work_dir"}, Usage: "Temporary working directory", Field: func(c *Config) any { return &c.WorkDir }},
+	{Name: "force_colors", Live: true, Flags: []string{"color"}, Usage: "Force color-output (default: auto-detect)", Field: func(c *Config) any { return &c.ForceColors }},
+	{Name: "terminal_emulator", Live: true, Flags: []string{"terminal_emulator"}, Usage: "Command to start terminal-emulator, e.g. 'konsole -e'", Field: func(c *Config) any { return &c.TerminalEmulator }},
+	{Name: "debounce", Live: true, Flags: []string{"debounce"}, Usage: "Debounce before sync (in milliseconds)", Field: func(c *Config) any { return &c.Debounce }},
+	{Name: "shrink_threshold", Live: true, Flags: []string{"shrink_threshold"}, Usage: "Ask before uploading a database that shrunk by more than this (in percent, 0 = disabled)", Field: func(c *Config) any { return &c.ShrinkThreshold }},
+	{Name: "min_size", Live: true, Flags: []string{"min_size"}, Usage: "Ask before uploading a database smaller than this (in bytes, 0 = disabled)", Field: func(c *Config) any { return &c.MinSize }},
+	{Name: "watch_mode", Flags: []string{"watch_mode"}, Usage: "How to detect changes of the database: auto | inotify | poll", Field: func(c *Config) any { return &c.WatchMode }},
+	{Name: "poll_interval", Live: true, Flags: []string{"poll_interval"}, Usage: "Interval for watch_mode=poll (in milliseconds)", Field: func(c *Config) any { return &c.PollInterval }},
+	{Name: "launcher", Live: true, OnLaunch: true, Secrets: []string{"env"}, Field: func(c *Config) any { return &c.Launcher }},
+	{Name: "unlock", Live: true, OnLaunch: true, Secrets: []string{"password_command", "secret_service"}, Field: func(c *Config) any { return &c.Unlock }},
+	{Name: "no_launch", Flags: []string{"no-launch", "daemon"}, Usage: "Daemon mode: only sync the database in the work dir, don't start keepassxc", Field: func(c *Config) any { return &c.NoLaunch }},
+	{Name: "shutdown_grace", Live: true, Flags: []string{"shutdown_grace"}, Usage: "How long to wait for keepassxc to quit (and save) before terminating it (in milliseconds)", Field: func(c *Config) any { return &c.ShutdownGrace }},
+	{Name: "fast_start", Flags: []string{"fast_start"}, Usage: "Start keepassxc on the cached database and check the remote in the background", Field: func(c *Config) any { return &c.FastStart }},
+	{Name: "resident", Flags: []string{"resident"}, Usage: "Keep running in the tray after keepassxc exits", Field: func(c *Config) any { return &c.Resident }},
+	{Name: "resident_pull_interval", Live: true, Flags: []string{"resident_pull_interval"}, Usage: "How often to pull remote changes while resident and keepassxc is closed (in milliseconds)", Field: func(c *Config) any { return &c.ResidentPullInterval }},
+	{Name: "notify_success", Live: true, Flags: []string{"notify_success"}, Usage: "Show a notification after every successful sync", Field: func(c *Config) any { return &c.NotifySuccess }},
+	{Name: "log_level", Live: true, Flags: []string{"log_level"}, Usage: "Minimum level of log messages: debug | info | warn | error", Field: func(c *Config) any { return &c.LogLevel }},
+	{Name: "log_json", Flags: []string{"log_json"}, Usage: "Additionally write the log as JSON-lines to this file", Field: func(c *Config) any { return &c.LogJSON }},
+}
+
+func (k configKey) EnvVar() string {
+	return "KPSYNC_" + strings.ToUpper(k.Name)
+}
+
+// setString parses v (from an env var or a flag) into the field of k,
+// nested objects (launcher, unlock) are expected as JSON
+func (k configKey) setString(c *Config, v string) error {
+	switch p := k.Field(c).(type) {
+	case *string:
+		*p = v
+	case **string:
+		if v == "" {
+			*p = nil
+		} else {
+			*p = langext.Ptr(v)
+		}
+	case *int:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return exerr.New(exerr.TypeInternal, fmt.Sprintf("'%s' is not an integer", v)).Str("key", k.Name).Build()
+		}
+		*p = i
+	case *int64:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return exerr.New(exerr.TypeInternal, fmt.Sprintf("'%s' is not an integer", v)).Str("key", k.Name).Build()
+		}
+		*p = i
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return exerr.New(exerr.TypeInternal, fmt.Sprintf("'%s' is not a boolean", v)).Str("key", k.Name).Build()
+		}
+		*p = b
+	default:
+		dec := json.NewDecoder(strings.NewReader(v))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(p); err != nil {
+			return exerr.New(exerr.TypeInternal, "invalid JSON: "+jsonErrorMessage(err)).Str("key", k.Name).Build()
+		}
+	}
+	return nil
+}
+
+// copyValue copies the value of k from src to dst
+func (k configKey) copyValue(dst *Config, src *Config) {
+	switch p := k.Field(dst).(type) {
+	case *string:
+		*p = *k.Field(src).(*string)
+	case **string:
+		*p = *k.Field(src).(**string)
+	case *int:
+		*p = *k.Field(src).(*int)
+	case *int64:
+		*p = *k.Field(src).(*int64)
+	case *bool:
+		*p = *k.Field(src).(*bool)
+	case **LauncherConfig:
+		*p = *k.Field(src).(**LauncherConfig)
+	case **UnlockConfig:
+		*p = *k.Field(src).(**UnlockConfig)
+	}
+}
+
+// configFlag is a command line flag of a config key, the value is only recorded while parsing
+// and applied on top of the other layers (so that explicitly set zero values like `-color=false` work)
+type configFlag struct {
+	isBool bool
+	value  *string
+}
+
+func (f configFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
 }
 
-func (app *Application) loadConfig() (Config, string) {
+func (f configFlag) Set(v string) error {
+	*f.value = v
+	return nil
+}
+
+func (f configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// configOverride is a value that was set via a command line flag
+type configOverride struct {
+	Key    configKey
+	Source string
+	Value  string
+}
+
+// cfg returns the current config (a reload replaces it as a whole, so the returned value is never modified).
+// Returns the zero config until the config is loaded.
+func (app *Application) cfg() *Config {
+	if c := app.config.Load(); c != nil {
+		return c
+	}
+	return &Config{}
+}
+
+func (app *Application) setConfig(c Config) {
+	app.config.Store(&c)
+}
+
+// loadConfig parses the command line flags in args (the remaining arguments are available via flag.Args())
+// and loads the config from all layers (see buildConfig)
+func (app *Application) loadConfig(args []string) string {
 	var configPath string
-	flag.StringVar(&configPath, "config", "~/.config/kpsync.json", "Path to the configuration file")
+	flag.StringVar(&configPath, "config", "", fmt.Sprintf("Path to the configuration file (default: %s)", xdgConfigPath()))
+
+	flagValues := make(map[string]*string)
+	for _, k := range configKeys {
+		_, isBool := k.Field(&Config{}).(*bool)
+		for i, fn := range k.Flags {
+			flagValues[fn] = langext.Ptr("")
+			usage := k.Usage
+			if i > 0 {
+				usage = "Alias for -" + k.Flags[0]
+			}
+			flag.Var(configFlag{isBool: isBool, value: flagValues[fn]}, fn, usage)
+		}
+	}
+
+	flag.BoolVar(&app.debugUnsafe, "debug-unsafe", false, "Do not redact passwords and tokens in the log (only for debugging)")
+
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		app.LogFatalErr("Failed to parse command line", err)
+	}
 
-	var webdavURL string
-	flag.StringVar(&webdavURL, "webdav_url", "", "WebDAV URL")
+	if app.debugUnsafe {
+		app.LogWarn("--debug-unsafe is set - passwords and tokens are NOT redacted in the log")
+	}
 
-	var webdavUser string
-	flag.StringVar(&webdavUser, "webdav_user", "", "WebDAV User")
+	overrides := make([]configOverride, 0)
+	flag.Visit(func(f *flag.Flag) {
+		for _, k := range configKeys {
+			if slices.Contains(k.Flags, f.Name) {
+				overrides = append(overrides, configOverride{Key: k, Source: "flag -" + f.Name, Value: *flagValues[f.Name]})
+			}
+		}
+	})
+
+	if configPath == "" {
+		configPath = os.Getenv("KPSYNC_CONFIG")
+	}
+	app.configPath = expandHome(configPath)
+	app.configFlags = overrides
 
-	var webdavPass string
-	flag.StringVar(&webdavPass, "webdav_pass", "", "WebDAV Password")
+	app.writePlaceholderConfig()
 
-	var localFallback string
-	flag.StringVar(&localFallback, "local_fallback", "", "Local fallback database")
+	cfg, sources, files, problems := app.buildConfig()
+	problems = append(problems, validateConfig(cfg, sources)...)
 
-	var workDir string
-	flag.StringVar(&workDir, "work_dir", "", "Temporary working directory")
+	app.configSources = sources
+	app.configFiles = files
+	app.configProblems = problems
 
-	var forceColors bool
-	flag.BoolVar(&forceColors, "color", false, "Force color-output (default: auto-detect)")
+	app.setConfig(cfg)
 
-	var terminalEmulator string
-	flag.StringVar(&terminalEmulator, "terminal_emulator", "", "Command to start terminal-emulator, e.g. 'konsole -e'")
+	app.openJSONLog(cfg.LogJSON)
+
+	if !app.configLenient {
+		failed := false
+		for _, p := range problems {
+			if p.Severity == ConfigProblemError {
+				app.LogError("Config: "+p.String(), nil)
+				failed = true
+			} else {
+				app.LogWarn("Config: " + p.String())
+			}
+		}
+		if failed {
+			app.LogFatal("Invalid config (see `kpsync config validate`)")
+		}
+	}
 
-	var debounce int
-	flag.IntVar(&debounce, "debounce", 0, "Debounce before sync (in seconds)")
+	if len(files) == 0 {
+		return "<defaults>"
+	}
+	return strings.Join(files, ", ")
+}
+
+// configFileLayers returns the config files (in order of precedence, lowest first) that are read if they exist
+func (app *Application) configFileLayers() []string {
+	if app.configPath != "" {
+		return []string{"/etc/kpsync.json", app.configPath}
+	}
+	return []string{"/etc/kpsync.json", expandHome("~/.config/kpsync.json"), xdgConfigPath()}
+}
+
+// buildConfig merges the config layers: built-in defaults < /etc/kpsync.json < user config file < KPSYNC_* env vars < flags.
+// Returns the config, the source of every key, the config files that were read and all problems found while decoding them.
+func (app *Application) buildConfig() (Config, map[string]string, []string, []ConfigProblem) {
+	cfg := defaultConfig("", detectTerminalEmulator())
+
+	sources := make(map[string]string, len(configKeys))
+	for _, k := range configKeys {
+		sources[k.Name] = "default"
+	}
 
-	flag.Parse()
+	files := make([]string, 0, 3)
+	problems := make([]ConfigProblem, 0)
 
-	if strings.HasPrefix(configPath, "~") {
-		usr, err := user.Current()
+	for _, fp := range app.configFileLayers() {
+		if !fileExists(fp) {
+			continue
+		}
+
+		bin, err := os.ReadFile(fp)
 		if err != nil {
-			app.LogFatalErr("Failed to query users home directory", err)
+			problems = append(problems, ConfigProblem{Severity: ConfigProblemError, Source: fp, Message: "failed to read file: " + err.Error()})
+			continue
 		}
 
-		configPath = strings.TrimPrefix(configPath, "~")
-		configPath = path.Join(usr.HomeDir, configPath)
+		problems = append(problems, decodeConfigFile(fp, bin, &cfg, sources)...)
+
+		files = append(files, fp)
 	}
 
-	if _, err := os.Stat(configPath); os.IsNotExist(err) && configPath != "" {
+	for _, k := range configKeys {
+		if v, ok := os.LookupEnv(k.EnvVar()); ok {
+			if err := k.setString(&cfg, v); err != nil {
+				problems = append(problems, ConfigProblem{Severity: ConfigProblemError, Source: "env " + k.EnvVar(), Key: k.Name, Message: err.Error()})
+				continue
+			}
+			sources[k.Name] = "env " + k.EnvVar()
+		}
+	}
 
-		te := ""
-		if commandExists("konsole") {
-			te = "konsole -e"
-		} else if commandExists("gnome-terminal") {
-			te = "gnome-terminal --"
-		} else if commandExists("xterm") {
-			te = "xterm -e"
-		} else if commandExists("x-terminal-emulator") {
-			te = "x-terminal-emulator -e"
-		} else {
-			app.LogError("Failed to determine terminal-emulator", nil)
+	for _, o := range app.configFlags {
+		if err := o.Key.setString(&cfg, o.Value); err != nil {
+			problems = append(problems, ConfigProblem{Severity: ConfigProblemError, Source: o.Source, Key: o.Key.Name, Message: err.Error()})
+			continue
 		}
+		sources[o.Key.Name] = o.Source
+	}
+
+	return cfg, sources, files, problems
+}
 
-		_ = os.WriteFile(configPath, langext.Must(json.MarshalIndent(Config{
-			WebDAVURL:        "https://your-nextcloud-domain.example/remote.php/dav/files/keepass.kdbx",
-			WebDAVUser:       "",
-			WebDAVPass:       "",
-			LocalFallback:    nil,
-			WorkDir:          "/tmp/kpsync",
-			Debounce:         3500,
-			ForceColors:      false,
-			TerminalEmulator: te,
-		}, "", "    ")), 0644)
+// decodeConfigFile merges the keys that are present in the config file bin into cfg.
+// Decoding is strict, unknown keys (also in nested objects) and values of the wrong type are reported with their line and column.
+func decodeConfigFile(fp string, bin []byte, cfg *Config, sources map[string]string) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	add := func(offset int64, key string, msg string) {
+		problems = append(problems, ConfigProblem{Severity: ConfigProblemError, Source: fileLocation(fp, bin, offset), Key: key, Message: msg})
 	}
 
-	cfgBin, err := os.ReadFile(configPath)
-	if err != nil {
-		app.LogFatalErr("Failed to read config file from "+configPath, err)
+	dec := json.NewDecoder(bytes.NewReader(bin))
+
+	if tok, err := dec.Token(); err != nil {
+		add(jsonErrorOffset(err, dec.InputOffset()), "", jsonErrorMessage(err))
+		return problems
+	} else if tok != json.Delim('{') {
+		add(0, "", "config must be a JSON object")
+		return problems
 	}
 
-	var cfg Config
-	err = json.Unmarshal(cfgBin, &cfg)
-	if err != nil {
-		app.LogFatalErr("Failed to parse config file from "+configPath, err)
+	seen := make(map[string]bool)
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			add(jsonErrorOffset(err, dec.InputOffset()), "", jsonErrorMessage(err))
+			return problems
+		}
+
+		name, _ := tok.(string)
+		keyOffset := dec.InputOffset() - int64(len(langext.Must(json.Marshal(name))))
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			add(jsonErrorOffset(err, dec.InputOffset()), name, jsonErrorMessage(err))
+			return problems
+		}
+		valueOffset := dec.InputOffset() - int64(len(raw))
+
+		k, ok := findConfigKey(name)
+		if !ok {
+			if sug := suggestConfigKey(name); sug != "" {
+				add(keyOffset, name, fmt.Sprintf("unknown field (did you mean '%s'?)", sug))
+			} else {
+				add(keyOffset, name, "unknown field")
+			}
+			continue
+		}
+
+		if seen[name] {
+			add(keyOffset, name, "duplicate field")
+			continue
+		}
+		seen[name] = true
+
+		vdec := json.NewDecoder(bytes.NewReader(raw))
+		vdec.DisallowUnknownFields()
+		if err := vdec.Decode(k.Field(cfg)); err != nil {
+			add(valueOffset+jsonErrorOffset(err, 0), name, jsonErrorMessage(err))
+			continue
+		}
+
+		sources[name] = fileLocation(fp, bin, keyOffset)
 	}
 
-	if webdavURL != "" {
-		cfg.WebDAVURL = webdavURL
+	if _, err := dec.Token(); err != nil {
+		add(jsonErrorOffset(err, dec.InputOffset()), "", jsonErrorMessage(err))
+		return problems
 	}
-	if webdavUser != "" {
-		cfg.WebDAVUser = webdavUser
+	if _, err := dec.Token(); err != io.EOF {
+		add(dec.InputOffset(), "", "unexpected data after the config object")
 	}
-	if webdavPass != "" {
-		cfg.WebDAVPass = webdavPass
+
+	return problems
+}
+
+func findConfigKey(name string) (configKey, bool) {
+	for _, k := range configKeys {
+		if k.Name == name {
+			return k, true
+		}
 	}
-	if localFallback != "" {
-		cfg.LocalFallback = &localFallback
+	return configKey{}, false
+}
+
+// suggestConfigKey returns the known key that is closest to name (for typos), or "" if none is similar enough
+func suggestConfigKey(name string) string {
+	best, bestDist := "", 3
+	for _, k := range configKeys {
+		if d := editDistance(strings.ToLower(name), k.Name); d < bestDist {
+			best, bestDist = k.Name, d
+		}
 	}
-	if workDir != "" {
-		cfg.WorkDir = workDir
+	return best
+}
+
+// editDistance returns the levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
 	}
-	if debounce > 0 {
-		cfg.Debounce = debounce
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
 	}
-	if forceColors {
-		cfg.ForceColors = forceColors
+	return prev[len(b)]
+}
+
+// fileLocation formats a byte offset in bin as `{file}:{line}:{column}`
+func fileLocation(fp string, bin []byte, offset int64) string {
+	offset = max(0, min(offset, int64(len(bin))))
+
+	line, col := 1, 1
+	for _, c := range bin[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
 	}
-	if terminalEmulator != "" {
-		cfg.TerminalEmulator = terminalEmulator
+
+	return fmt.Sprintf("%s:%d:%d", fp, line, col)
+}
+
+// jsonErrorOffset returns the position of a json syntax/type error (or fallback if the error has none)
+func jsonErrorOffset(err error, fallback int64) int64 {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return syntaxErr.Offset
 	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return typeErr.Offset
+	}
+	return fallback
+}
+
+func jsonErrorMessage(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field != "" {
+			return fmt.Sprintf("%s: expected %s, got %s", typeErr.Field, typeErr.Type.String(), typeErr.Value)
+		}
+		return fmt.Sprintf("expected %s, got %s", typeErr.Type.String(), typeErr.Value)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "unexpected end of file"
+	}
+	return strings.TrimPrefix(err.Error(), "json: ")
+}
 
-	return cfg, configPath
+// writePlaceholderConfig writes an example config if no config file exists at all
+func (app *Application) writePlaceholderConfig() {
+	for _, fp := range app.configFileLayers() {
+		if fileExists(fp) {
+			return
+		}
+	}
+
+	fp := app.configPath
+	if fp == "" {
+		fp = xdgConfigPath()
+	}
+
+	te := detectTerminalEmulator()
+	if te == "" {
+		app.LogError("Failed to determine terminal-emulator", nil)
+	}
+
+	app.LogInfo(fmt.Sprintf("No config found - writing placeholder config to %s (or run `kpsync init`)", fp))
+
+	_ = os.MkdirAll(path.Dir(fp), 0700)
+	_ = os.WriteFile(fp, langext.Must(json.MarshalIndent(defaultConfig("https://your-nextcloud-domain.example/remote.php/dav/files/keepass.kdbx", te), "", "    ")), 0600)
+}
+
+// xdgConfigPath returns the path of the user config file ($XDG_CONFIG_HOME/kpsync/config.json)
+func xdgConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = expandHome("~/.config")
+	}
+	return path.Join(dir, "kpsync", "config.json")
+}
+
+// defaultConfig returns a config with the default values (as written to a new config file)
+func defaultConfig(webdavURL string, terminalEmulator string) Config {
+	return Config{
+		WebDAVURL:            webdavURL,
+		WebDAVUser:           "",
+		WebDAVPass:           "",
+		LocalFallback:        nil,
+		WorkDir:              "/tmp/kpsync",
+		Debounce:             3500,
+		ForceColors:          false,
+		TerminalEmulator:     terminalEmulator,
+		ShrinkThreshold:      50,
+		MinSize:              1024,
+		WatchMode:            string(WatchModeAuto),
+		PollInterval:         2000,
+		ShutdownGrace:        30000,
+		FastStart:            false,
+		Resident:             false,
+		ResidentPullInterval: 300000,
+		NotifySuccess:        true,
+		LogLevel:             string(LogLevelDebug),
+		LogJSON:              "",
+	}
+}
+
+// detectTerminalEmulator returns the command to run something in a terminal (e.g. `konsole -e`), or "" if none was found
+func detectTerminalEmulator() string {
+	if commandExists("konsole") {
+		return "konsole -e"
+	} else if commandExists("gnome-terminal") {
+		return "gnome-terminal --"
+	} else if commandExists("xterm") {
+		return "xterm -e"
+	} else if commandExists("x-terminal-emulator") {
+		return "x-terminal-emulator -e"
+	}
+	return ""
 }
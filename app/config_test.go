@@ -0,0 +1,182 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestDecodeConfigFile(t *testing.T) {
+	type problem struct {
+		key    string
+		source string
+	}
+
+	tests := []struct {
+		name     string
+		json     string
+		want     func(c Config) bool
+		problems []problem
+	}{
+		{
+			name: "valid",
+			json: "{\n  \"webdav_url\": \"https://dav.test/db.kdbx\",\n  \"debounce\": 1500\n}",
+			want: func(c Config) bool { return c.WebDAVURL == "https://dav.test/db.kdbx" && c.Debounce == 1500 },
+		},
+		{
+			name: "empty object keeps the previous values",
+			json: "{}",
+			want: func(c Config) bool { return c.WorkDir == "/previous" },
+		},
+		{
+			name: "null pointer",
+			json: `{"local_fallback": null}`,
+			want: func(c Config) bool { return c.LocalFallback == nil },
+		},
+		{
+			name: "nested object",
+			json: `{"launcher": {"command": "keepassxc {db}", "args": ["--minimized"]}}`,
+			want: func(c Config) bool {
+				return c.Launcher != nil && c.Launcher.Command == "keepassxc {db}" && len(c.Launcher.Args) == 1
+			},
+		},
+		{
+			name:     "unknown key with suggestion",
+			json:     "{\n  \"webdav_ulr\": \"x\"\n}",
+			problems: []problem{{"webdav_ulr", "test.json:2:3"}},
+		},
+		{
+			name:     "unknown nested key",
+			json:     `{"unlock": {"keyfile": "x"}}`,
+			problems: []problem{{"unlock", ""}},
+		},
+		{
+			name:     "wrong type",
+			json:     "{\n  \"debounce\": \"fast\"\n}",
+			problems: []problem{{"debounce", ""}},
+		},
+		{
+			name:     "duplicate key",
+			json:     `{"debounce": 1, "debounce": 2}`,
+			want:     func(c Config) bool { return c.Debounce == 1 },
+			problems: []problem{{"debounce", ""}},
+		},
+		{
+			name:     "multiple problems",
+			json:     `{"foo": 1, "debounce": "x", "work_dir": "/tmp"}`,
+			want:     func(c Config) bool { return c.WorkDir == "/tmp" },
+			problems: []problem{{"foo", ""}, {"debounce", ""}},
+		},
+		{
+			name:     "syntax error",
+			json:     "{\n  \"debounce\": 1,\n}",
+			problems: []problem{{"", ""}},
+		},
+		{
+			name:     "not an object",
+			json:     `["webdav_url"]`,
+			problems: []problem{{"", "test.json:1:1"}},
+		},
+		{
+			name:     "empty file",
+			json:     "",
+			problems: []problem{{"", ""}},
+		},
+		{
+			name:     "trailing data",
+			json:     `{} {}`,
+			problems: []problem{{"", ""}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{WorkDir: "/previous"}
+			sources := make(map[string]string)
+
+			problems := decodeConfigFile("test.json", []byte(tt.json), &cfg, sources)
+
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("decodeConfigFile() returned %d problems, want %d: %v", len(problems), len(tt.problems), problems)
+			}
+			for i, p := range problems {
+				if p.Severity != ConfigProblemError {
+					t.Errorf("problem %d: severity = %s, want %s", i, p.Severity, ConfigProblemError)
+				}
+				if p.Key != tt.problems[i].key {
+					t.Errorf("problem %d: key = %q, want %q (%s)", i, p.Key, tt.problems[i].key, p)
+				}
+				if tt.problems[i].source != "" && p.Source != tt.problems[i].source {
+					t.Errorf("problem %d: source = %q, want %q", i, p.Source, tt.problems[i].source)
+				}
+			}
+
+			if tt.want != nil && !tt.want(cfg) {
+				t.Errorf("decodeConfigFile() decoded unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestDecodeConfigFileSources(t *testing.T) {
+	cfg := Config{}
+	sources := make(map[string]string)
+
+	problems := decodeConfigFile("test.json", []byte("{\n  \"webdav_url\": \"https://dav.test/db.kdbx\",\n    \"debounce\": 10\n}"), &cfg, sources)
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	if sources["webdav_url"] != "test.json:2:3" {
+		t.Errorf("sources[webdav_url] = %q, want %q", sources["webdav_url"], "test.json:2:3")
+	}
+	if sources["debounce"] != "test.json:3:5" {
+		t.Errorf("sources[debounce] = %q, want %q", sources["debounce"], "test.json:3:5")
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"debounce", "debounce", 0},
+		{"debounse", "debounce", 1},
+		{"webdav_ulr", "webdav_url", 2},
+		{"workdir", "work_dir", 1},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			if got := editDistance(tt.a, tt.b); got != tt.want {
+				t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := editDistance(tt.b, tt.a); got != tt.want {
+				t.Errorf("editDistance(%q, %q) = %d, want %d (not symmetric)", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuggestConfigKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"webdav_ulr", "webdav_url"},
+		{"WorkDir", "work_dir"},
+		{"debounse", "debounce"},
+		{"completely_unknown", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := suggestConfigKey(tt.name); got != tt.want {
+				t.Errorf("suggestConfigKey(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
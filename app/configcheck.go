@@ -0,0 +1,181 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
+)
+
+type ConfigProblemSeverity string //@enum:type
+
+const (
+	ConfigProblemError   ConfigProblemSeverity = "ERROR"   // kpsync refuses to start
+	ConfigProblemWarning ConfigProblemSeverity = "WARNING" // kpsync starts, but some functionality is not available
+)
+
+const (
+	maxDebounce     = 10 * 60 * 1000 // (in ms)
+	minPollInterval = 100            // (in ms)
+	maxPollInterval = 60 * 60 * 1000 // (in ms)
+)
+
+type ConfigProblem struct {
+	Severity ConfigProblemSeverity
+	Source   string // file (with line and column), env var, flag or "default"
+	Key      string // config key (empty for syntax errors)
+	Message  string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Key == "" {
+		return fmt.Sprintf("%s: %s: %s", p.Source, p.Severity, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", p.Source, p.Severity, p.Key, p.Message)
+}
+
+// validateConfig checks the values of cfg (sources is used to report where an invalid value came from)
+func validateConfig(cfg Config, sources map[string]string) []ConfigProblem {
+	problems := make([]ConfigProblem, 0)
+	add := func(sev ConfigProblemSeverity, key string, msg string) {
+		problems = append(problems, ConfigProblem{Severity: sev, Source: sources[key], Key: key, Message: msg})
+	}
+
+	// webdav_url
+
+	if cfg.WebDAVURL == "" {
+		add(ConfigProblemError, "webdav_url", "missing (run `kpsync init`)")
+	} else if u, err := url.Parse(cfg.WebDAVURL); err != nil {
+		add(ConfigProblemError, "webdav_url", "not a valid URL: "+err.Error())
+	} else if u.Scheme == "" {
+		add(ConfigProblemError, "webdav_url", fmt.Sprintf("'%s' is not an absolute URL (must start with https://)", cfg.WebDAVURL))
+	} else if u.Scheme != "https" && u.Scheme != "http" {
+		add(ConfigProblemError, "webdav_url", fmt.Sprintf("unsupported scheme '%s' (must be https:// or http://)", u.Scheme))
+	} else if u.Host == "" {
+		add(ConfigProblemError, "webdav_url", "missing host")
+	} else if strings.HasSuffix(u.Host, ".example") {
+		add(ConfigProblemError, "webdav_url", "still the placeholder URL (edit the config or run `kpsync init`)")
+	} else if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		add(ConfigProblemError, "webdav_url", "must be the URL of the database file, not of a directory")
+	} else {
+		if u.User != nil {
+			add(ConfigProblemWarning, "webdav_url", "contains credentials, use webdav_user / webdav_pass instead")
+		}
+		if u.Scheme == "http" && cfg.WebDAVPass != "" {
+			add(ConfigProblemWarning, "webdav_url", "credentials are sent unencrypted (http://)")
+		}
+	}
+
+	// local_fallback (only a warning - it could be on a drive that is not mounted right now)
+
+	if cfg.LocalFallback != nil {
+		if *cfg.LocalFallback == "" {
+			add(ConfigProblemError, "local_fallback", "empty path (use null to disable the fallback)")
+		} else if !fileExists(*cfg.LocalFallback) {
+			add(ConfigProblemWarning, "local_fallback", fmt.Sprintf("'%s' not found - the fallback option won't be available", *cfg.LocalFallback))
+		}
+	}
+
+	// work_dir
+
+	if cfg.WorkDir == "" {
+		add(ConfigProblemError, "work_dir", "missing")
+	} else if err := checkDirWritable(cfg.WorkDir); err != nil {
+		add(ConfigProblemError, "work_dir", err.Error())
+	}
+
+	// terminal_emulator (only needed for `Show Log (fifo)`)
+
+	if te := strings.Fields(cfg.TerminalEmulator); len(te) > 0 && !commandExists(te[0]) {
+		add(ConfigProblemWarning, "terminal_emulator", fmt.Sprintf("'%s' not found - `Show Log (fifo)` won't work (detected: '%s')", te[0], detectTerminalEmulator()))
+	}
+
+	// numbers
+
+	if cfg.Debounce < 0 || cfg.Debounce > maxDebounce {
+		add(ConfigProblemError, "debounce", fmt.Sprintf("must be between 0 and %d ms (is %d)", maxDebounce, cfg.Debounce))
+	}
+	if cfg.ShrinkThreshold < 0 || cfg.ShrinkThreshold > 100 {
+		add(ConfigProblemError, "shrink_threshold", fmt.Sprintf("must be between 0 and 100 %% (is %d)", cfg.ShrinkThreshold))
+	}
+	if cfg.MinSize < 0 {
+		add(ConfigProblemError, "min_size", fmt.Sprintf("must not be negative (is %d)", cfg.MinSize))
+	}
+	if cfg.PollInterval != 0 && (cfg.PollInterval < minPollInterval || cfg.PollInterval > maxPollInterval) {
+		add(ConfigProblemError, "poll_interval", fmt.Sprintf("must be between %d and %d ms (is %d)", minPollInterval, maxPollInterval, cfg.PollInterval))
+	}
+	if cfg.ShutdownGrace < 0 {
+		add(ConfigProblemError, "shutdown_grace", fmt.Sprintf("must not be negative (is %d)", cfg.ShutdownGrace))
+	}
+	if cfg.ResidentPullInterval < 0 {
+		add(ConfigProblemError, "resident_pull_interval", fmt.Sprintf("must not be negative (is %d)", cfg.ResidentPullInterval))
+	}
+
+	// watch_mode
+
+	if !slices.Contains([]WatchMode{WatchModeAuto, WatchModeInotify, WatchModePoll}, WatchMode(cfg.WatchMode)) {
+		add(ConfigProblemError, "watch_mode", fmt.Sprintf("unknown mode '%s' (must be auto, inotify or poll)", cfg.WatchMode))
+	}
+
+	// log_level
+
+	if !slices.Contains(logLevelOrder, LogLevel(cfg.LogLevel)) {
+		add(ConfigProblemError, "log_level", fmt.Sprintf("unknown level '%s' (must be debug, info, warn or error)", cfg.LogLevel))
+	}
+
+	if cfg.LogJSON != "" {
+		if err := checkDirWritable(path.Dir(expandHome(cfg.LogJSON))); err != nil {
+			add(ConfigProblemError, "log_json", err.Error())
+		}
+	}
+
+	// launcher
+
+	if cfg.Launcher != nil && strings.TrimSpace(cfg.Launcher.Command) != "" {
+		if tokens, err := splitCommandLine(cfg.Launcher.Command); err != nil || len(tokens) == 0 {
+			add(ConfigProblemError, "launcher", fmt.Sprintf("invalid command '%s': %s", cfg.Launcher.Command, errString(err)))
+		} else if !cfg.NoLaunch && !commandExists(tokens[0]) {
+			add(ConfigProblemError, "launcher", fmt.Sprintf("'%s' not found", tokens[0]))
+		}
+	}
+
+	// unlock
+
+	if cfg.Unlock != nil && cfg.Unlock.KeyFile != "" && !fileExists(expandHome(cfg.Unlock.KeyFile)) {
+		add(ConfigProblemError, "unlock", fmt.Sprintf("key_file '%s' not found", expandHome(cfg.Unlock.KeyFile)))
+	}
+
+	return problems
+}
+
+// checkDirWritable checks that dir (or, if it does not exist yet, its nearest existing parent) is a writable directory
+func checkDirWritable(dir string) error {
+	p, err := filepath.Abs(dir)
+	if err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+
+	for !fileExists(p) && path.Dir(p) != p {
+		p = path.Dir(p)
+	}
+
+	if fi, err := os.Stat(p); err != nil {
+		return exerr.Wrap(err, "").Build()
+	} else if !fi.IsDir() {
+		return exerr.New(exerr.TypeInternal, fmt.Sprintf("'%s' is not a directory", p)).Build()
+	}
+
+	probe := path.Join(p, ".kpsync-check-"+langext.RandBase62(8))
+	if err := os.WriteFile(probe, []byte{}, 0600); err != nil {
+		return exerr.New(exerr.TypeInternal, fmt.Sprintf("'%s' is not writable", p)).Build()
+	}
+	_ = os.Remove(probe)
+
+	return nil
+}
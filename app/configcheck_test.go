@@ -0,0 +1,85 @@
+package app
+
+import (
+	"path"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	workDir := t.TempDir()
+
+	valid := func() Config {
+		return Config{
+			WebDAVURL:  "https://dav.test/remote.php/dav/files/me/db.kdbx",
+			WebDAVUser: "me",
+			WebDAVPass: "secret",
+			WorkDir:    workDir,
+			Debounce:   3500,
+			WatchMode:  string(WatchModeAuto),
+			LogLevel:   string(LogLevelInfo),
+		}
+	}
+
+	type problem struct {
+		key      string
+		severity ConfigProblemSeverity
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []problem
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"missing url", func(c *Config) { c.WebDAVURL = "" }, []problem{{"webdav_url", ConfigProblemError}}},
+		{"relative url", func(c *Config) { c.WebDAVURL = "dav.test/db.kdbx" }, []problem{{"webdav_url", ConfigProblemError}}},
+		{"unsupported scheme", func(c *Config) { c.WebDAVURL = "ftp://dav.test/db.kdbx" }, []problem{{"webdav_url", ConfigProblemError}}},
+		{"placeholder url", func(c *Config) { c.WebDAVURL = "https://nextcloud.example/db.kdbx" }, []problem{{"webdav_url", ConfigProblemError}}},
+		{"directory url", func(c *Config) { c.WebDAVURL = "https://dav.test/files/" }, []problem{{"webdav_url", ConfigProblemError}}},
+		{"credentials in url", func(c *Config) { c.WebDAVURL = "https://me:pw@dav.test/db.kdbx" }, []problem{{"webdav_url", ConfigProblemWarning}}},
+		{"plain http with password", func(c *Config) { c.WebDAVURL = "http://dav.test/db.kdbx" }, []problem{{"webdav_url", ConfigProblemWarning}}},
+		{"empty fallback", func(c *Config) { c.LocalFallback = new(string) }, []problem{{"local_fallback", ConfigProblemError}}},
+		{"missing fallback", func(c *Config) { fb := path.Join(workDir, "missing.kdbx"); c.LocalFallback = &fb }, []problem{{"local_fallback", ConfigProblemWarning}}},
+		{"missing work dir", func(c *Config) { c.WorkDir = "" }, []problem{{"work_dir", ConfigProblemError}}},
+		{"unknown terminal", func(c *Config) { c.TerminalEmulator = "kpsync-test-no-such-terminal -e" }, []problem{{"terminal_emulator", ConfigProblemWarning}}},
+		{"negative debounce", func(c *Config) { c.Debounce = -1 }, []problem{{"debounce", ConfigProblemError}}},
+		{"debounce too large", func(c *Config) { c.Debounce = maxDebounce + 1 }, []problem{{"debounce", ConfigProblemError}}},
+		{"shrink threshold", func(c *Config) { c.ShrinkThreshold = 101 }, []problem{{"shrink_threshold", ConfigProblemError}}},
+		{"negative min size", func(c *Config) { c.MinSize = -1 }, []problem{{"min_size", ConfigProblemError}}},
+		{"poll interval too small", func(c *Config) { c.PollInterval = minPollInterval - 1 }, []problem{{"poll_interval", ConfigProblemError}}},
+		{"poll interval default", func(c *Config) { c.PollInterval = 0 }, nil},
+		{"negative shutdown grace", func(c *Config) { c.ShutdownGrace = -1 }, []problem{{"shutdown_grace", ConfigProblemError}}},
+		{"negative resident pull interval", func(c *Config) { c.ResidentPullInterval = -1 }, []problem{{"resident_pull_interval", ConfigProblemError}}},
+		{"unknown watch mode", func(c *Config) { c.WatchMode = "fanotify" }, []problem{{"watch_mode", ConfigProblemError}}},
+		{"unknown log level", func(c *Config) { c.LogLevel = "trace" }, []problem{{"log_level", ConfigProblemError}}},
+		{"invalid launcher", func(c *Config) { c.Launcher = &LauncherConfig{Command: `keepassxc "{db}`} }, []problem{{"launcher", ConfigProblemError}}},
+		{"unknown launcher", func(c *Config) { c.Launcher = &LauncherConfig{Command: "kpsync-test-no-such-launcher {db}"} }, []problem{{"launcher", ConfigProblemError}}},
+		{"unknown launcher in daemon mode", func(c *Config) {
+			c.Launcher = &LauncherConfig{Command: "kpsync-test-no-such-launcher {db}"}
+			c.NoLaunch = true
+		}, nil},
+		{"missing key file", func(c *Config) { c.Unlock = &UnlockConfig{KeyFile: path.Join(workDir, "missing.keyx")} }, []problem{{"unlock", ConfigProblemError}}},
+		{"multiple", func(c *Config) { c.Debounce = -1; c.LogLevel = "" }, []problem{{"debounce", ConfigProblemError}, {"log_level", ConfigProblemError}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(&cfg)
+
+			problems := validateConfig(cfg, map[string]string{"debounce": "test.json:3:5"})
+
+			if len(problems) != len(tt.want) {
+				t.Fatalf("validateConfig() returned %d problems, want %d: %v", len(problems), len(tt.want), problems)
+			}
+			for i, p := range problems {
+				if p.Key != tt.want[i].key || p.Severity != tt.want[i].severity {
+					t.Errorf("problem %d = %s, want %s: %s", i, p, tt.want[i].severity, tt.want[i].key)
+				}
+				if p.Key == "debounce" && p.Source != "test.json:3:5" {
+					t.Errorf("problem %d: source = %q, want the source of the value", i, p.Source)
+				}
+			}
+		})
+	}
+}
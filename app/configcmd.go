@@ -0,0 +1,157 @@
+package app
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
+)
+
+const redactedValue = "********"
+
+// RunConfig implements `kpsync config <show [--effective]|validate>`
+func (app *Application) RunConfig(args []string) int {
+	if len(args) == 0 {
+		app.LogError("Missing command - usage: kpsync config <show [--effective]|validate> [flags]", nil)
+		return 2
+	}
+
+	app.headless = true
+	app.configLenient = true // we want to show/list the problems instead of aborting
+
+	switch args[0] {
+	case "show":
+		return app.runConfigShow(args[1:])
+	case "validate":
+		return app.runConfigValidate(args[1:])
+	default:
+		app.LogError("Unknown command '"+args[0]+"' - usage: kpsync config <show [--effective]|validate> [flags]", nil)
+		return 2
+	}
+}
+
+// runConfigShow prints the merged config (secrets redacted),
+// with --effective every value is printed together with the layer it came from
+func (app *Application) runConfigShow(args []string) int {
+	effective := flag.Bool("effective", false, "Print every value together with its source")
+
+	app.loadConfig(args)
+
+	if !*effective {
+		values := make(map[string]any, len(configKeys))
+		for _, k := range configKeys {
+			values[k.Name] = json.RawMessage(app.configValueString(k))
+		}
+		fmt.Println(string(langext.Must(json.MarshalIndent(values, "", "    "))))
+		return 0
+	}
+
+	fmt.Println("Config files:")
+	for _, fp := range app.configFileLayers() {
+		if slices.Contains(app.configFiles, fp) {
+			fmt.Printf("  %s (loaded)\n", fp)
+		} else {
+			fmt.Printf("  %s (not found)\n", fp)
+		}
+	}
+	fmt.Println()
+
+	width := 0
+	for _, k := range configKeys {
+		width = max(width, len(k.Name))
+	}
+
+	for _, k := range configKeys {
+		fmt.Printf("%s%s = %s  [%s]\n", k.Name, strings.Repeat(" ", width-len(k.Name)), app.configValueString(k), app.configSources[k.Name])
+	}
+
+	return 0
+}
+
+// runConfigValidate prints all problems of the config (syntax, unknown keys, invalid values).
+// Returns 0 if the config is valid (warnings are allowed) and 1 otherwise.
+func (app *Application) runConfigValidate(args []string) int {
+	app.loadConfig(args)
+
+	errCount := 0
+	warnCount := 0
+	for _, p := range app.configProblems {
+		fmt.Println(p.String())
+		if p.Severity == ConfigProblemError {
+			errCount++
+		} else {
+			warnCount++
+		}
+	}
+
+	if len(app.configProblems) > 0 {
+		fmt.Println()
+	}
+
+	if errCount > 0 {
+		fmt.Printf("Config is invalid: %d error(s), %d warning(s)\n", errCount, warnCount)
+		return 1
+	}
+
+	if warnCount > 0 {
+		fmt.Printf("Config is valid: %d warning(s)\n", warnCount)
+	} else {
+		fmt.Println("Config is valid")
+	}
+	return 0
+}
+
+// configValueString returns the (JSON encoded) value of k in the current config, secrets are redacted
+func (app *Application) configValueString(k configKey) string {
+	bin, err := json.Marshal(k.Field(app.cfg()))
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+
+	if k.Secret {
+		return string(redactJSONValue(bin))
+	}
+
+	if len(k.Secrets) > 0 {
+		obj := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(bin, &obj); err != nil || obj == nil {
+			return string(bin) // null
+		}
+		for _, f := range k.Secrets {
+			if v, ok := obj[f]; ok {
+				obj[f] = redactJSONValue(v)
+			}
+		}
+		return string(langext.Must(json.Marshal(obj)))
+	}
+
+	return string(bin)
+}
+
+// redactJSONValue replaces a (non-empty) string with redactedValue, objects and arrays are redacted element-wise (keys are kept)
+func redactJSONValue(v json.RawMessage) json.RawMessage {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(v, &obj); err == nil && obj != nil {
+		for key, val := range obj {
+			obj[key] = redactJSONValue(val)
+		}
+		return langext.Must(json.Marshal(obj))
+	}
+
+	var arr []json.RawMessage
+	if err := json.Unmarshal(v, &arr); err == nil && arr != nil {
+		for i, val := range arr {
+			arr[i] = redactJSONValue(val)
+		}
+		return langext.Must(json.Marshal(arr))
+	}
+
+	if s := string(v); s == `""` || s == "null" {
+		return v
+	}
+
+	return json.RawMessage(`"` + redactedValue + `"`)
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/timeext"
+	"github.com/fsnotify/fsnotify"
+)
+
+const configReloadDebounce = 500 * time.Millisecond // editors often write a file in several steps
+
+// runConfigWatcher watches the config files and reloads the config when one of them changes.
+// The directories are watched (not the files), because editors often replace the file instead of writing it.
+func (app *Application) runConfigWatcher() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		app.LogError("Failed to create config watcher - config changes are only applied after a restart", err)
+		return
+	}
+	defer func() { _ = watcher.Close() }()
+
+	files := app.configFileLayers()
+
+	dirs := make([]string, 0, len(files))
+	for _, fp := range files {
+		if dir := path.Dir(fp); !slices.Contains(dirs, dir) && fileExists(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			app.LogWarn(fmt.Sprintf("Failed to watch config directory '%s': %s", dir, err.Error()))
+		}
+	}
+
+	app.LogDebug(fmt.Sprintf("Watching config files %v", files))
+
+	var reload <-chan time.Time = nil // nil channel - never fires until a config file changed
+
+	for {
+		select {
+		case <-app.sigConfigStopChan:
+			app.LogDebug("Stopping config watcher (received signal)")
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !slices.Contains(files, event.Name) {
+				continue // no log, other files in ~/.config change all the time
+			}
+			app.LogDebug(fmt.Sprintf("Received config inotify event: [%s] %s", event.Op.String(), event.Name))
+			reload = time.After(configReloadDebounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			app.LogError("Config watcher error", err)
+
+		case <-reload:
+			reload = nil
+			app.reloadConfig()
+		}
+	}
+}
+
+// reloadConfig re-reads all config layers and applies the changed values that are safe to change while running
+// (see configKey.Live). Other changes are reported, they need a restart of kpsync.
+// An invalid config is not applied at all.
+func (app *Application) reloadConfig() {
+	app.LogInfo("Config changed - reloading")
+
+	cfg, sources, files, problems := app.buildConfig()
+	problems = append(problems, validateConfig(cfg, sources)...)
+
+	invalid := false
+	for _, p := range problems {
+		if p.Severity == ConfigProblemError {
+			app.LogError("Config: "+p.String(), nil)
+			invalid = true
+		} else {
+			app.LogWarn("Config: " + p.String())
+		}
+	}
+
+	if invalid {
+		app.LogError("Changed config is invalid - keeping the current config", nil)
+		app.showErrorNotification("KeePassSync", "The changed config is invalid and was not applied (see `kpsync config validate`).")
+		app.LogLine()
+		return
+	}
+
+	applied := make([]configKey, 0)
+	onLaunch := make([]string, 0)
+	restart := make([]string, 0)
+
+	app.masterLock.Lock()
+	newCfg := *app.cfg()
+	for _, k := range configKeys {
+		if configValueEqual(k, &newCfg, &cfg) {
+			continue
+		}
+		if k.Live {
+			k.copyValue(&newCfg, &cfg)
+			applied = append(applied, k)
+			if k.OnLaunch {
+				onLaunch = append(onLaunch, k.Name)
+			}
+		} else {
+			restart = append(restart, k.Name)
+			sources[k.Name] = app.configSources[k.Name] // still the value from the start
+		}
+	}
+	app.setConfig(newCfg) // replaced as a whole, readers (without lock) see either the old or the new config
+	app.configSources = sources
+	app.configFiles = files
+	app.configProblems = problems
+	app.masterLock.Unlock()
+
+	for _, k := range applied {
+		app.LogInfo(fmt.Sprintf("Config: applied %s = %s", k.Name, app.configValueString(k)))
+
+		if k.Name == "debounce" && app.uploadDCI != nil {
+			app.uploadDCI.SetDelay(timeext.FromMilliseconds(newCfg.Debounce))
+		}
+	}
+
+	if len(onLaunch) > 0 {
+		app.LogInfo(fmt.Sprintf("Config: changes of [%s] are used the next time keepassxc is started", strings.Join(onLaunch, ", ")))
+	}
+
+	if len(restart) > 0 {
+		app.LogWarn(fmt.Sprintf("Config: changes of [%s] are only applied after a restart of kpsync", strings.Join(restart, ", ")))
+		app.showErrorNotification("KeePassSync", fmt.Sprintf("Restart kpsync to apply the config changes of: %s", strings.Join(restart, ", ")))
+		app.setTrayRestartHint("Restart required: " + strings.Join(restart, ", "))
+	} else {
+		app.setTrayRestartHint("")
+	}
+
+	if len(applied) > 0 && len(onLaunch) > 0 {
+		app.showSuccessNotification("KeePassSync", fmt.Sprintf("Config reloaded (%d value(s) changed)\n%s: used the next time KeePassXC is started", len(applied), strings.Join(onLaunch, ", ")))
+	} else if len(applied) > 0 {
+		app.showSuccessNotification("KeePassSync", fmt.Sprintf("Config reloaded (%d value(s) changed)", len(applied)))
+	} else if len(restart) == 0 {
+		app.LogInfo("Config: nothing changed")
+	}
+
+	app.LogLine()
+}
+
+func configValueEqual(k configKey, a *Config, b *Config) bool {
+	va, errA := json.Marshal(k.Field(a))
+	vb, errB := json.Marshal(k.Field(b))
+	return errA == nil && errB == nil && bytes.Equal(va, vb)
+}
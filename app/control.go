@@ -0,0 +1,427 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/cryptext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+	"mikescher.com/kpsync/assets"
+)
+
+// The control socket speaks newline-delimited JSON-RPC 2.0 (one request per line, one response per line)
+
+const (
+	controlErrParse          = -32700
+	controlErrMethodNotFound = -32601
+	controlErrInvalidParams  = -32602
+	controlErrInternal       = -32603
+	controlErrNotReady       = -32000 // initial sync not finished yet
+)
+
+type ControlRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      any             `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type ControlResponse struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      any           `json:"id"`
+	Result  any           `json:"result,omitempty"`
+	Error   *ControlError `json:"error,omitempty"`
+}
+
+type ControlError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type ControlStatus struct {
+	PID            int          `json:"pid"`
+	WorkDir        string       `json:"work_dir"`
+	DBFile         string       `json:"db_file"`
+	SyncReady      bool         `json:"sync_ready"`
+	Paused         bool         `json:"paused"`
+	KeepassRunning bool         `json:"keepass_running"`
+	UploadWaiting  bool         `json:"upload_waiting"`
+	UploadActive   bool         `json:"upload_active"`
+	State          *CachedState `json:"state"`
+	LocalChecksum  string       `json:"local_checksum"`
+	InSync         bool         `json:"in_sync"`
+}
+
+// controlSocketPath returns the path of the control socket of the instance that uses config.WorkDir
+func (app *Application) controlSocketPath() string {
+	wd := app.cfg().WorkDir
+	if abs, err := filepath.Abs(wd); err == nil {
+		wd = abs
+	}
+
+	name := fmt.Sprintf("kpsync-%s.sock", cryptext.BytesSha256([]byte(wd))[:12])
+
+	return path.Join(app.controlSocketDir(), name)
+}
+
+// controlSocketDir returns the (private, mode 0700) directory of the control socket
+func (app *Application) controlSocketDir() string {
+	if rd := os.Getenv("XDG_RUNTIME_DIR"); rd != "" {
+		return path.Join(rd, "kpsync")
+	}
+	return path.Join(app.cfg().WorkDir, "kpsync.ctl")
+}
+
+// prepareControlSocketDir creates dir with mode 0700 (or restricts an existing one), so that the socket is never
+// accessible by other users - not even between net.Listen and the chmod of the socket file
+func prepareControlSocketDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+	if !fi.IsDir() {
+		return exerr.New(exerr.TypeInternal, fmt.Sprintf("'%s' is not a directory", dir)).Build()
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return exerr.New(exerr.TypeInternal, fmt.Sprintf("'%s' is owned by another user (uid %d)", dir, st.Uid)).Build()
+	}
+
+	if fi.Mode().Perm() != 0700 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return exerr.Wrap(err, "").Build()
+		}
+	}
+
+	return nil
+}
+
+func (app *Application) startControlSocket() {
+	sp := app.controlSocketPath()
+
+	if err := prepareControlSocketDir(path.Dir(sp)); err != nil {
+		app.LogError("Failed to create control socket directory", err)
+		return
+	}
+
+	if fileExists(sp) {
+		if conn, err := net.DialTimeout("unix", sp, time.Second); err == nil {
+			_ = conn.Close()
+			app.LogWarn(fmt.Sprintf("Control socket '%s' is in use by another instance - control socket disabled", sp))
+			return
+		}
+		app.LogDebug(fmt.Sprintf("Removing stale control socket '%s'", sp))
+		_ = os.Remove(sp)
+	}
+
+	ln, err := net.Listen("unix", sp)
+	if err != nil {
+		app.LogError("Failed to create control socket", err)
+		return
+	}
+
+	if err := os.Chmod(sp, 0600); err != nil {
+		app.LogError("Failed to set permissions of control socket", err)
+		_ = ln.Close()
+		return
+	}
+
+	app.masterLock.Lock()
+	app.controlListener = ln
+	app.masterLock.Unlock()
+
+	app.LogInfo(fmt.Sprintf("Listening on control socket '%s'", sp))
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				app.LogError("Failed to accept control connection", err)
+				continue
+			}
+			go app.handleControlConn(conn)
+		}
+	}()
+}
+
+func (app *Application) stopControlSocket() {
+	app.masterLock.Lock()
+	ln := app.controlListener
+	app.controlListener = nil
+	app.masterLock.Unlock()
+
+	if ln != nil {
+		_ = ln.Close() // also removes the socket file
+	}
+}
+
+func (app *Application) handleControlConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	enc := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var req ControlRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			_ = enc.Encode(ControlResponse{JSONRPC: "2.0", Error: &ControlError{Code: controlErrParse, Message: err.Error()}})
+			continue
+		}
+
+		app.LogDebug(fmt.Sprintf("Control socket: received [%s]", req.Method))
+
+		result, cerr := app.dispatchControlRequest(req)
+
+		resp := ControlResponse{JSONRPC: "2.0", ID: req.ID, Result: result, Error: cerr}
+		if err := enc.Encode(resp); err != nil {
+			app.LogError("Failed to write control response", err)
+			return
+		}
+	}
+}
+
+func (app *Application) dispatchControlRequest(req ControlRequest) (any, *ControlError) {
+	requireReady := func() *ControlError {
+		if !app.syncReady.Get() {
+			return &ControlError{Code: controlErrNotReady, Message: "initial sync not finished"}
+		}
+		return nil
+	}
+
+	switch req.Method {
+
+	case "status":
+		return app.controlStatus(), nil
+
+	case "sync":
+		if cerr := requireReady(); cerr != nil {
+			return nil, cerr
+		}
+		var params struct {
+			Force bool `json:"force"`
+		}
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, &ControlError{Code: controlErrInvalidParams, Message: err.Error()}
+			}
+		}
+		app.runExplicitSync(params.Force)
+		return app.controlStatus(), nil
+
+	case "pull":
+		if cerr := requireReady(); cerr != nil {
+			return nil, cerr
+		}
+		r, err := app.runPull()
+		if err != nil {
+			return nil, &ControlError{Code: controlErrInternal, Message: err.Error()}
+		}
+		return map[string]any{"result": r}, nil
+
+	case "pause":
+		app.syncPaused.Set(true)
+		app.uploadDCI.CancelPendingRequests()
+		app.LogInfo("Sync paused (control socket)")
+		app.setTrayStateDirect("Sync paused", assets.IconDefault)
+		return app.controlStatus(), nil
+
+	case "resume":
+		app.syncPaused.Set(false)
+		app.LogInfo("Sync resumed (control socket)")
+		app.setTrayStateDirect("Sleeping...", assets.IconDefault)
+		if app.syncReady.Get() && fileExists(app.dbFile) {
+			app.onDBFileChanged("resume") // upload changes made while paused
+		}
+		return app.controlStatus(), nil
+
+	case "quit":
+		app.LogInfo("Quit requested (control socket)")
+		app.sigQuitChan <- true
+		return map[string]any{"quitting": true}, nil
+
+	case "log":
+		var params struct {
+			Lines int `json:"lines"`
+		}
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, &ControlError{Code: controlErrInvalidParams, Message: err.Error()}
+			}
+		}
+		if params.Lines <= 0 {
+			params.Lines = 50
+		}
+		return app.logTail(params.Lines), nil
+
+	default:
+		return nil, &ControlError{Code: controlErrMethodNotFound, Message: "unknown method: " + req.Method}
+	}
+}
+
+func (app *Application) controlStatus() ControlStatus {
+	st := ControlStatus{
+		PID:            os.Getpid(),
+		WorkDir:        app.cfg().WorkDir,
+		DBFile:         app.dbFile,
+		SyncReady:      app.syncReady.Get(),
+		Paused:         app.syncPaused.Get(),
+		KeepassRunning: app.keepassRunning.Get(),
+		UploadWaiting:  app.uploadWaiting.Get(),
+		UploadActive:   app.uploadActive.Get(),
+	}
+
+	if app.stateFile != "" {
+		st.State = newCachedState(app.readState())
+	}
+	if app.dbFile != "" {
+		if cs, err := app.calcLocalChecksum(); err == nil {
+			st.LocalChecksum = cs
+		}
+	}
+
+	st.InSync = st.State != nil && st.LocalChecksum == st.State.Checksum && !st.UploadWaiting && !st.UploadActive
+
+	return st
+}
+
+// logTail returns the last n log lines
+func (app *Application) logTail(n int) []string {
+	app.logLock.Lock()
+	defer app.logLock.Unlock()
+
+	start := len(app.logList) - n
+	if start < 0 {
+		start = 0
+	}
+
+	res := make([]string, 0, len(app.logList)-start)
+	for _, v := range app.logList[start:] {
+		res = append(res, v.Text())
+	}
+	return res
+}
+
+// RunCtl implements `kpsync ctl [flags] <status|sync [force]|pull|pause|resume|quit|log [n]>`:
+// sends a command to the running instance (via the control socket).
+// Returns 0 on success, 1 if the command failed and 2 if no instance is running.
+func (app *Application) RunCtl(args []string) int {
+	app.headless = true
+	app.configLenient = true // the running instance still uses the config it was started with
+
+	app.loadConfig(args)
+
+	rest := flag.Args()
+	if len(rest) == 0 {
+		app.LogError("Missing command - usage: kpsync ctl [flags] <status|sync [force]|pull|pause|resume|quit|log [n]>", nil)
+		return 2
+	}
+
+	method := rest[0]
+	var params any = nil
+
+	switch method {
+	case "sync":
+		force := len(rest) > 1 && (rest[1] == "force" || rest[1] == "--force")
+		params = map[string]any{"force": force}
+	case "log":
+		n := 50
+		if len(rest) > 1 {
+			v, err := strconv.Atoi(rest[1])
+			if err != nil {
+				app.LogError("Invalid line count: "+rest[1], nil)
+				return 2
+			}
+			n = v
+		}
+		params = map[string]any{"lines": n}
+	}
+
+	resp, err := app.callControlSocket(method, params)
+	if err != nil {
+		app.LogError("Failed to talk to running instance (is kpsync running?)", err)
+		return 2
+	}
+
+	if resp.Error != nil {
+		fmt.Printf("Error %d: %s\n", resp.Error.Code, resp.Error.Message)
+		return 1
+	}
+
+	if method == "log" {
+		var lines []string
+		if err := json.Unmarshal(resp.Result, &lines); err == nil {
+			for _, l := range lines {
+				fmt.Println(l)
+			}
+			return 0
+		}
+	}
+
+	var pretty any
+	if err := json.Unmarshal(resp.Result, &pretty); err == nil {
+		if bin, err := json.MarshalIndent(pretty, "", "  "); err == nil {
+			fmt.Println(string(bin))
+			return 0
+		}
+	}
+	fmt.Println(string(resp.Result))
+
+	return 0
+}
+
+type controlClientResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *ControlError   `json:"error"`
+}
+
+func (app *Application) callControlSocket(method string, params any) (*controlClientResponse, error) {
+	conn, err := net.DialTimeout("unix", app.controlSocketPath(), 2*time.Second)
+	if err != nil {
+		return nil, exerr.Wrap(err, "").Build()
+	}
+	defer func() { _ = conn.Close() }()
+
+	req := map[string]any{"jsonrpc": "2.0", "id": 1, "method": method}
+	if params != nil {
+		req["params"] = params
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, exerr.Wrap(err, "").Build()
+	}
+
+	// no read deadline - sync may wait for the user to answer a conflict notification
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return nil, exerr.Wrap(scanner.Err(), "").Build()
+		}
+		return nil, exerr.New(exerr.TypeInternal, "connection closed without response").Build()
+	}
+
+	var resp controlClientResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		return nil, exerr.Wrap(err, "invalid response").Build()
+	}
+
+	return &resp, nil
+}
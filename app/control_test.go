@@ -0,0 +1,46 @@
+package app
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPrepareControlSocketDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(dir string) error
+		wantErr bool
+	}{
+		{"missing", func(dir string) error { return nil }, false},
+		{"existing private", func(dir string) error { return os.Mkdir(dir, 0700) }, false},
+		{"existing world readable", func(dir string) error { return os.Mkdir(dir, 0755) }, false},
+		{"file", func(dir string) error { return os.WriteFile(dir, []byte{}, 0600) }, true},
+		{"symlink", func(dir string) error { return os.Symlink(os.TempDir(), dir) }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := path.Join(t.TempDir(), "kpsync")
+			if err := tt.setup(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			err := prepareControlSocketDir(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareControlSocketDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			fi, err := os.Stat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0700 {
+				t.Errorf("mode of '%s' = %o, want 700", dir, fi.Mode().Perm())
+			}
+		})
+	}
+}
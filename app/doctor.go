@@ -0,0 +1,290 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/cmdext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
+	"github.com/fsnotify/fsnotify"
+)
+
+type DoctorStatus string //@enum:type
+
+const (
+	DoctorPass DoctorStatus = "PASS"
+	DoctorWarn DoctorStatus = "WARN"
+	DoctorFail DoctorStatus = "FAIL"
+	DoctorSkip DoctorStatus = "SKIP"
+)
+
+type DoctorResult struct {
+	Name   string
+	Status DoctorStatus
+	Detail string
+	Fix    string
+}
+
+// RunDoctor implements `kpsync doctor`: checks all prerequisites and the capabilities of the WebDAV server.
+// Returns 0 if no check failed, 1 otherwise.
+func (app *Application) RunDoctor(args []string) int {
+	app.configLenient = true // an invalid config is reported as a result instead of aborting
+
+	initErr := app.initCommand(args)
+
+	results := make([]DoctorResult, 0, 16)
+	add := func(name string, status DoctorStatus, detail string, fix string) {
+		results = append(results, DoctorResult{Name: name, Status: status, Detail: detail, Fix: fix})
+	}
+
+	fmt.Println("Checking config...")
+	app.doctorConfig(add)
+
+	if initErr != nil {
+		add("work directory", DoctorFail, initErr.Error(), "choose a writable work_dir")
+	} else {
+		fmt.Println("Checking environment...")
+		app.doctorEnvironment(add)
+
+		fmt.Println("Checking server...")
+		app.doctorServer(add)
+	}
+
+	fmt.Println()
+
+	failed := 0
+	for _, r := range results {
+		fmt.Printf("[%s] %s: %s\n", r.Status, r.Name, r.Detail)
+		if r.Fix != "" && (r.Status == DoctorFail || r.Status == DoctorWarn) {
+			fmt.Printf("       Fix: %s\n", r.Fix)
+		}
+		if r.Status == DoctorFail {
+			failed++
+		}
+	}
+
+	fmt.Println()
+
+	if failed > 0 {
+		fmt.Printf("%d check(s) failed\n", failed)
+		return 1
+	}
+
+	fmt.Println("All checks passed")
+	return 0
+}
+
+// doctorConfig reports the problems found while loading the config
+func (app *Application) doctorConfig(add func(string, DoctorStatus, string, string)) {
+	if len(app.configProblems) == 0 {
+		files := "<defaults>"
+		if len(app.configFiles) > 0 {
+			files = strings.Join(app.configFiles, ", ")
+		}
+		add("config", DoctorPass, "valid ("+files+")", "")
+		return
+	}
+
+	for _, p := range app.configProblems {
+		name := "config"
+		if p.Key != "" {
+			name = "config: " + p.Key
+		}
+
+		status := DoctorWarn
+		if p.Severity == ConfigProblemError {
+			status = DoctorFail
+		}
+
+		add(name, status, fmt.Sprintf("%s (%s)", p.Message, p.Source), "fix the config, see `kpsync config validate`")
+	}
+}
+
+func (app *Application) doctorEnvironment(add func(string, DoctorStatus, string, string)) {
+
+	// notifications
+
+	if !commandExists("notify-send") {
+		add("notify-send", DoctorFail, "not found - conflicts and errors can't be reported", "install libnotify (e.g. `pacman -S libnotify` / `apt install libnotify-bin`)")
+	} else {
+		add("notify-send", DoctorPass, "found", "")
+
+		if res, err := cmdext.Runner("notify-send").Arg("--help").Run(); err != nil || !strings.Contains(res.StdOut+res.StdErr, "--action") {
+			add("notify-send --action", DoctorFail, "notify-send does not support --action (libnotify < 0.7.10?) - conflict questions can't be asked", "update libnotify")
+		} else if caps, err := notificationCapabilities(); err != nil {
+			add("notification daemon", DoctorWarn, "failed to query capabilities: "+err.Error(), "make sure a notification daemon is running")
+		} else if !slices.Contains(caps, "actions") {
+			add("notification daemon", DoctorFail, fmt.Sprintf("daemon does not support actions (capabilities: %v) - conflict questions can't be asked", caps), "use a notification daemon with action support (e.g. the one of KDE/GNOME, dunst, mako)")
+		} else {
+			add("notification daemon", DoctorPass, "supports actions", "")
+		}
+	}
+
+	// file watcher
+
+	if WatchMode(app.cfg().WatchMode) == WatchModePoll {
+		add("inotify", DoctorSkip, "watch_mode=poll", "")
+	} else if fs, unsupported := inotifyUnsupported(app.cfg().WorkDir); unsupported {
+		if WatchMode(app.cfg().WatchMode) == WatchModeInotify {
+			add("inotify", DoctorFail, fmt.Sprintf("work dir is on a '%s' filesystem, inotify does not work reliably there", fs), "set \"watch_mode\": \"auto\" or \"poll\", or use a local work_dir")
+		} else {
+			add("inotify", DoctorWarn, fmt.Sprintf("work dir is on a '%s' filesystem - the polling watcher is used", fs), "use a local work_dir")
+		}
+	} else if w, err := fsnotify.NewWatcher(); err != nil {
+		add("inotify", DoctorFail, "failed to create watcher: "+err.Error(), "check fs.inotify.max_user_instances (sysctl) or set \"watch_mode\": \"poll\"")
+	} else {
+		if err := w.Add(app.cfg().WorkDir); err != nil {
+			add("inotify", DoctorFail, "failed to watch work dir: "+err.Error(), "check fs.inotify.max_user_watches (sysctl) or set \"watch_mode\": \"poll\"")
+		} else {
+			add("inotify", DoctorPass, "work dir can be watched", "")
+		}
+		_ = w.Close()
+	}
+
+	// work dir
+
+	probe := path.Join(app.cfg().WorkDir, ".kpsync-doctor-"+langext.RandBase62(8))
+	if err := os.WriteFile(probe, []byte("probe"), 0600); err != nil {
+		add("work_dir", DoctorFail, fmt.Sprintf("'%s' is not writable: %s", app.cfg().WorkDir, err.Error()), "choose a writable work_dir")
+	} else {
+		_ = os.Remove(probe)
+		add("work_dir", DoctorPass, fmt.Sprintf("'%s' is writable", app.cfg().WorkDir), "")
+	}
+
+	// keepassxc / launcher
+
+	if app.cfg().NoLaunch {
+		add("launcher", DoctorSkip, "no_launch is set", "")
+	} else if tokens, err := splitCommandLine(app.launcherConfig().Command); err != nil || len(tokens) == 0 {
+		add("launcher", DoctorFail, fmt.Sprintf("invalid launcher command '%s'", app.launcherConfig().Command), "fix launcher.command in the config")
+	} else if !commandExists(tokens[0]) {
+		add("launcher", DoctorFail, fmt.Sprintf("'%s' not found", tokens[0]), "install keepassxc (or fix launcher.command)")
+	} else {
+		add("launcher", DoctorPass, fmt.Sprintf("'%s' found", tokens[0]), "")
+	}
+
+	// terminal emulator
+
+	if te := strings.Fields(app.cfg().TerminalEmulator); len(te) == 0 {
+		add("terminal_emulator", DoctorWarn, "not configured - `Show Log (fifo)` won't work", fmt.Sprintf("set \"terminal_emulator\" (detected: '%s')", detectTerminalEmulator()))
+	} else if !commandExists(te[0]) {
+		add("terminal_emulator", DoctorWarn, fmt.Sprintf("'%s' not found - `Show Log (fifo)` won't work", te[0]), fmt.Sprintf("set \"terminal_emulator\" (detected: '%s')", detectTerminalEmulator()))
+	} else {
+		add("terminal_emulator", DoctorPass, fmt.Sprintf("'%s' found", te[0]), "")
+	}
+
+	// unlock
+
+	if app.cfg().Unlock != nil && app.cfg().Unlock.KeyFile != "" {
+		if kf := expandHome(app.cfg().Unlock.KeyFile); !fileExists(kf) {
+			add("unlock.key_file", DoctorFail, fmt.Sprintf("'%s' not found", kf), "fix unlock.key_file in the config")
+		} else {
+			add("unlock.key_file", DoctorPass, fmt.Sprintf("'%s' found", kf), "")
+		}
+	}
+	if app.cfg().Unlock != nil && len(app.cfg().Unlock.SecretService) > 0 && app.cfg().Unlock.PasswordCommand == "" && !commandExists("secret-tool") {
+		add("unlock.secret_service", DoctorFail, "secret-tool not found", "install libsecret")
+	}
+}
+
+func (app *Application) doctorServer(add func(string, DoctorStatus, string, string)) {
+
+	if app.cfg().WebDAVURL == "" {
+		add("webdav_url", DoctorFail, "not configured", "run `kpsync init`")
+		return
+	}
+
+	dirURL := app.cfg().WebDAVURL[:strings.LastIndex(app.cfg().WebDAVURL, "/")+1]
+
+	op := app.beginOperation("doctor")
+	defer op.End()
+
+	// OPTIONS / DAV header
+
+	resp, err := app.davRequest(op, "OPTIONS", app.cfg().WebDAVURL, nil, nil)
+	if err != nil {
+		add("server", DoctorFail, "not reachable: "+err.Error(), "check webdav_url and your network connection")
+		return
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		add("credentials", DoctorFail, fmt.Sprintf("access denied (statuscode: %d)", resp.StatusCode), "check webdav_user / webdav_pass (Nextcloud with 2FA needs an app-password)")
+		return
+	}
+
+	if dav := resp.Header.Get("DAV"); dav == "" {
+		add("DAV", DoctorFail, fmt.Sprintf("OPTIONS response has no DAV header (statuscode: %d) - probably not a WebDAV endpoint", resp.StatusCode), "use the WebDAV URL of the file (Nextcloud: https://{host}/remote.php/dav/files/{user}/{path})")
+	} else {
+		add("DAV", DoctorPass, "DAV: "+dav, "")
+	}
+
+	// HEAD / ETag
+
+	if etag, _, err := app.getRemoteState(op); err != nil {
+		add("ETag", DoctorFail, "HEAD request failed or returned no ETag: "+err.Error(), "the server must return an ETag header for the database")
+	} else {
+		add("ETag", DoctorPass, "ETag: "+etag, "")
+	}
+
+	// conditional write
+
+	canWrite, ifMatch, err := app.probeConditionalWrite(op, dirURL)
+	if !canWrite {
+		add("write", DoctorFail, "failed to write a scratch file next to the database: "+errString(err), "check the permissions of the directory on the server")
+	} else {
+		add("write", DoctorPass, "scratch file created and deleted", "")
+		if ifMatch {
+			add("If-Match", DoctorPass, "stale ETag was rejected (412)", "")
+		} else {
+			add("If-Match", DoctorFail, "stale ETag was NOT rejected - conflicting changes would be overwritten silently", "use a server that supports conditional requests")
+		}
+	}
+
+	// quota
+
+	entries, err := app.davPropfind(op, dirURL, "0")
+	if err != nil || len(entries) == 0 {
+		add("quota", DoctorWarn, "PROPFIND failed: "+errString(err), "")
+	} else if q := entries[0]; q.QuotaAvailable < 0 {
+		add("quota", DoctorPass, fmt.Sprintf("unlimited (used: %s)", langext.FormatBytes(q.QuotaUsed)), "")
+	} else if q.QuotaAvailable == 0 && q.QuotaUsed == 0 {
+		add("quota", DoctorSkip, "not reported by the server", "") // (the properties are missing in the response)
+	} else if state := app.readState(); state != nil && q.QuotaAvailable < 2*state.Size {
+		add("quota", DoctorFail, fmt.Sprintf("only %s available (database: %s)", langext.FormatBytes(q.QuotaAvailable), langext.FormatBytes(state.Size)), "free up space on the server")
+	} else {
+		add("quota", DoctorPass, fmt.Sprintf("%s available (used: %s)", langext.FormatBytes(q.QuotaAvailable), langext.FormatBytes(q.QuotaUsed)), "")
+	}
+}
+
+// notificationCapabilities queries the capabilities of the running notification daemon (via D-Bus)
+func notificationCapabilities() ([]string, error) {
+	res, err := cmdext.
+		Runner("dbus-send").
+		Arg("--session").
+		Arg("--print-reply").
+		Arg("--dest=org.freedesktop.Notifications").
+		Arg("/org/freedesktop/Notifications").
+		Arg("org.freedesktop.Notifications.GetCapabilities").
+		Run()
+	if err != nil {
+		return nil, exerr.Wrap(err, "").Build()
+	}
+	if res.ExitCode != 0 {
+		return nil, exerr.New(exerr.TypeInternal, fmt.Sprintf("dbus-send failed (exit code %d): %s", res.ExitCode, strings.TrimSpace(res.StdErr))).Build()
+	}
+
+	caps := make([]string, 0)
+	for _, line := range strings.Split(res.StdOut, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "string "); ok {
+			caps = append(caps, strings.Trim(v, "\""))
+		}
+	}
+
+	return caps, nil
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const (
+	ExecExitSyncFailed   = 125 // kpsync itself failed (download, upload, conflict)
+	ExecExitCannotInvoke = 126 // the command could not be started
+	ExecExitNotFound     = 127 // the command was not found
+)
+
+// RunExec implements `kpsync exec [flags] -- <command>`:
+// download the database, run the command against the work-dir copy ({db} is replaced with its path)
+// and upload the database again if the command modified it.
+// Returns the exit code of the command, or ExecExitSyncFailed if the sync failed.
+func (app *Application) RunExec(args []string) int {
+	app.headless = true
+
+	configPath := app.loadConfig(args)
+
+	app.LogInfo(fmt.Sprintf("Loaded config from %s", configPath))
+	app.LogDebug(fmt.Sprintf("WebDAVURL     := '%s'", app.cfg().WebDAVURL))
+	app.LogDebug(fmt.Sprintf("WorkDir       := '%s'", app.cfg().WorkDir))
+	app.LogLine()
+
+	cmdArgs := flag.Args()
+	if len(cmdArgs) == 0 {
+		app.LogError("Missing command - usage: kpsync exec [flags] -- <command> [args...] ({db} is replaced with the database path)", nil)
+		return ExecExitSyncFailed
+	}
+
+	if pid, err := app.acquireInstanceLock(); err != nil {
+		app.LogError(fmt.Sprintf("Work dir is in use by another kpsync instance (PID %d)", pid), err)
+		return ExecExitSyncFailed
+	}
+	defer app.releaseInstanceLock()
+
+	isr, err := app.initSync()
+	if err != nil {
+		app.LogError("Failed to sync database", err)
+		return ExecExitSyncFailed
+	}
+	if isr != InitSyncResponseOkay {
+		app.LogError("Failed to download remote database ("+string(isr)+") - not running command", nil)
+		return ExecExitSyncFailed
+	}
+
+	state := app.readState()
+
+	for i := range cmdArgs {
+		cmdArgs[i] = strings.ReplaceAll(cmdArgs[i], "{db}", app.dbFile)
+	}
+
+	cmdExitCode := app.runExecCommand(cmdArgs)
+
+	localCS, err := app.calcLocalChecksum()
+	if err != nil {
+		app.LogError("Failed to calculate local database checksum", err)
+		return ExecExitSyncFailed
+	}
+
+	if state != nil && localCS == state.Checksum {
+		app.LogInfo("Database was not modified by the command - no need to upload")
+		return cmdExitCode
+	}
+
+	app.LogInfo("Database was modified by the command - uploading")
+
+	op := app.beginOperation("exec-upload")
+	defer op.End()
+
+	if !app.checkUploadSizeAnomaly(op, state) {
+		app.keepExecChanges("Upload skipped")
+		return ExecExitSyncFailed
+	}
+
+	err = app.doDBUpload(op, state, func() {}, false)
+	if errors.Is(err, ETagConflictError) {
+		app.keepExecChanges("Remote database was modified while the command was running (conflict)")
+		return ExecExitSyncFailed
+	}
+	if err != nil {
+		app.keepExecChanges("Failed to upload database")
+		return ExecExitSyncFailed
+	}
+
+	return cmdExitCode
+}
+
+// runExecCommand runs the command with inherited stdio (SIGINT/SIGTERM are forwarded), returns its exit code
+func (app *Application) runExecCommand(cmdArgs []string) int {
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "KPSYNC_DB="+app.dbFile)
+
+	app.LogDebug(fmt.Sprintf("Running command: %v", cmdArgs))
+
+	err := cmd.Start()
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		app.LogError(fmt.Sprintf("Command '%s' not found", cmdArgs[0]), err)
+		return ExecExitNotFound
+	}
+	if err != nil {
+		app.LogError(fmt.Sprintf("Failed to start command '%s'", cmdArgs[0]), err)
+		return ExecExitCannotInvoke
+	}
+
+	// we must survive a Ctrl+C to upload what the command has written
+	sigChan := make(chan os.Signal, 8)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	go func() {
+		for sig := range sigChan {
+			app.LogDebug(fmt.Sprintf("Forwarding signal %s to command", sig))
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+
+	exitErr := &exec.ExitError{}
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			app.LogWarn(fmt.Sprintf("Command was killed by signal %s", ws.Signal()))
+			return 128 + int(ws.Signal())
+		}
+		app.LogWarn(fmt.Sprintf("Command exited with code %d", exitErr.ExitCode()))
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		app.LogError("Failed to run command", err)
+		return ExecExitCannotInvoke
+	}
+
+	app.LogInfo("Command finished successfully")
+	app.LogLine()
+
+	return 0
+}
+
+// keepExecChanges saves a snapshot of the (not uploaded) database, the next download would overwrite it
+func (app *Application) keepExecChanges(reason string) {
+	fp, err := app.snapshotDatabase("exec")
+	if err != nil {
+		app.LogError(reason+" - failed to save the local changes", err)
+		return
+	}
+
+	app.LogError(fmt.Sprintf("%s - local changes are NOT synced, they were saved to '%s'", reason, fp), nil)
+}
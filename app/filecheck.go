@@ -0,0 +1,189 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+)
+
+const (
+	stabilitySampleInterval = 500 * time.Millisecond
+	stabilitySampleCount    = 3
+	stabilityTimeout        = 60 * time.Second
+	stabilityMaxPostpones   = 4 // an upload is postponed at most this often (each after stabilityTimeout), then the file is uploaded anyway
+)
+
+type fileSample struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// waitForStableFile blocks until app.dbFile looks completely written:
+// size+mtime unchanged over consecutive samples, a valid KDBX header and no other process holding it open for writing.
+// Returns false (and the reason) if the file did not become stable within stabilityTimeout.
+// If the file is stable but fails the KDBX validation it returns immediately (false, invalidKDBX=true) -
+// waiting would only delay the upload (or the shutdown), uploadDatabase rejects the file anyway.
+func (app *Application) waitForStableFile(op *syncOp) (stable bool, invalidKDBX bool, reason string) {
+	t0 := time.Now()
+
+	var prev *fileSample = nil
+	stableCount := 0
+
+	for {
+		if time.Since(t0) > stabilityTimeout {
+			return false, false, reason
+		}
+
+		if prev != nil {
+			time.Sleep(stabilitySampleInterval)
+		}
+
+		fi, err := os.Stat(app.dbFile)
+		if err != nil {
+			reason = "file not accessible: " + err.Error()
+			prev = nil
+			stableCount = 0
+			continue
+		}
+
+		curr := fileSample{Size: fi.Size(), ModTime: fi.ModTime()}
+
+		if prev == nil || *prev != curr {
+			prev = &curr
+			stableCount = 1
+			reason = "file is still changing"
+			continue
+		}
+
+		stableCount++
+		if stableCount < stabilitySampleCount {
+			continue
+		}
+
+		bin, err := os.ReadFile(app.dbFile)
+		if err != nil {
+			reason = "file not readable: " + err.Error()
+			stableCount = 0
+			continue
+		}
+		if err := validateKDBX(bin); err != nil {
+			return false, true, "invalid KDBX file: " + err.Error()
+		}
+
+		writers, err := findFileWriters(app.dbFile)
+		if err != nil {
+			op.LogError("Failed to check for processes writing to the database", err)
+		} else if len(writers) > 0 {
+			reason = fmt.Sprintf("file is opened for writing by PID %v", writers)
+			stableCount = 0
+			continue
+		}
+
+		if time.Since(t0) > stabilitySampleInterval*stabilitySampleCount*2 {
+			op.LogDebug(fmt.Sprintf("Database file became stable after %s", time.Since(t0)))
+		}
+
+		return true, false, ""
+	}
+}
+
+// postponeUnstableUpload decides what happens to an upload when waitForStableFile timed out.
+// It is postponed (returns true) up to stabilityMaxPostpones times in a row, after that - and always if canPostpone is false
+// (final sync) - the user is notified and the file is uploaded anyway (uploadDatabase still rejects an invalid KDBX file).
+func (app *Application) postponeUnstableUpload(op *syncOp, reason string, canPostpone bool) bool {
+	app.masterLock.Lock()
+	n := app.uploadPostpones
+	postpone := canPostpone && n < stabilityMaxPostpones
+	if postpone {
+		app.uploadPostpones++
+	} else {
+		app.uploadPostpones = 0
+	}
+	app.masterLock.Unlock()
+
+	if postpone {
+		op.LogWarn(fmt.Sprintf("Database file is still being written (%s) - postponing upload (%d/%d)", reason, n+1, stabilityMaxPostpones))
+		return true
+	}
+
+	op.LogWarn("Database file did not become stable (" + reason + ") - uploading anyway")
+	app.showErrorNotification("KeePassSync", "The database file did not stop changing ("+reason+").\nUploading it anyway.")
+	return false
+}
+
+func (app *Application) resetUploadPostpones() {
+	app.masterLock.Lock()
+	defer app.masterLock.Unlock()
+
+	app.uploadPostpones = 0
+}
+
+// findFileWriters returns the PIDs of all (other) processes that have fp opened for writing (via /proc/*/fd)
+func findFileWriters(fp string) ([]int, error) {
+	target, err := filepath.EvalSymlinks(fp)
+	if err != nil {
+		return nil, exerr.Wrap(err, "").Build()
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, exerr.Wrap(err, "Failed to list /proc").Build()
+	}
+
+	self := os.Getpid()
+
+	res := make([]int, 0)
+
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil || pid == self {
+			continue
+		}
+
+		fds, err := os.ReadDir(path.Join("/proc", p.Name(), "fd"))
+		if err != nil {
+			continue // process exited or not ours
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(path.Join("/proc", p.Name(), "fd", fd.Name()))
+			if err != nil || link != target {
+				continue
+			}
+
+			if isWriteFD(pid, fd.Name()) {
+				res = append(res, pid)
+				break
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func isWriteFD(pid int, fd string) bool {
+	bin, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "fdinfo", fd))
+	if err != nil {
+		return true // can't tell - assume the worst
+	}
+
+	for _, line := range strings.Split(string(bin), "\n") {
+		if v, ok := strings.CutPrefix(line, "flags:"); ok {
+			flags, err := strconv.ParseInt(strings.TrimSpace(v), 8, 64)
+			if err != nil {
+				return true
+			}
+			mode := flags & syscall.O_ACCMODE
+			return mode == syscall.O_WRONLY || mode == syscall.O_RDWR
+		}
+	}
+
+	return true
+}
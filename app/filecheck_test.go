@@ -0,0 +1,31 @@
+package app
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestWaitForStableFileInvalidKDBX(t *testing.T) {
+	app := NewApplication()
+	app.setConfig(Config{WorkDir: t.TempDir()})
+	app.dbFile = path.Join(app.cfg().WorkDir, "vault.kdbx")
+
+	if err := os.WriteFile(app.dbFile, []byte("not a keepass database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	op := app.beginOperation("test")
+	defer op.End()
+
+	t0 := time.Now()
+	stable, invalidKDBX, reason := app.waitForStableFile(op)
+
+	if stable || !invalidKDBX {
+		t.Errorf("waitForStableFile() = (%v, %v, %q), want (false, true, ...)", stable, invalidKDBX, reason)
+	}
+	if d := time.Since(t0); d > stabilitySampleInterval*stabilitySampleCount*2 {
+		t.Errorf("waitForStableFile() took %s for a stable invalid file", d)
+	}
+}
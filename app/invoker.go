@@ -0,0 +1,93 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/dataext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/mathext"
+)
+
+// uploadInvoker is the debounced invoker of runDBUpload.
+// It wraps a DelayedCombiningInvoker (which has a fixed delay) so the debounce can be changed while kpsync is running,
+// callers always use the same uploadInvoker.
+// The action never runs twice at the same time (also not if the invoker is replaced by SetDelay during an execution).
+type uploadInvoker struct {
+	lock     sync.Mutex
+	runLock  sync.Mutex
+	action   func()
+	onChange func(pending bool) // called after every request and execution
+	delay    time.Duration
+	dci      *dataext.DelayedCombiningInvoker
+}
+
+func newUploadInvoker(action func(), delay time.Duration, onChange func(pending bool)) *uploadInvoker {
+	inv := &uploadInvoker{action: action, onChange: onChange, delay: delay}
+	inv.dci = inv.newDCI(delay)
+	return inv
+}
+
+func (inv *uploadInvoker) newDCI(delay time.Duration) *dataext.DelayedCombiningInvoker {
+	dci := dataext.NewDelayedCombiningInvoker(inv.run, delay, mathext.Max(45*time.Second, delay*3))
+
+	dci.RegisterOnRequest(func(_ int, _ bool) { inv.onChange(inv.HasPendingRequests()) })
+	dci.RegisterOnExecutionDone(func() { inv.onChange(inv.HasPendingRequests()) })
+
+	return dci
+}
+
+// run executes the action, an execution of the previous invoker (before SetDelay) is waited for
+func (inv *uploadInvoker) run() {
+	inv.runLock.Lock()
+	defer inv.runLock.Unlock()
+
+	inv.action()
+}
+
+func (inv *uploadInvoker) current() *dataext.DelayedCombiningInvoker {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	return inv.dci
+}
+
+func (inv *uploadInvoker) Request() {
+	inv.current().Request()
+}
+
+func (inv *uploadInvoker) ExecuteNow() bool {
+	return inv.current().ExecuteNow()
+}
+
+func (inv *uploadInvoker) CancelPendingRequests() {
+	inv.current().CancelPendingRequests()
+}
+
+func (inv *uploadInvoker) HasPendingRequests() bool {
+	return inv.current().HasPendingRequests()
+}
+
+func (inv *uploadInvoker) CountPendingRequests() int {
+	return inv.current().CountPendingRequests()
+}
+
+// SetDelay changes the debounce by replacing the inner invoker, a pending request is carried over (and waits for the new delay).
+// An execution that is running on the old invoker finishes first, the next one waits for it (see run).
+func (inv *uploadInvoker) SetDelay(delay time.Duration) {
+	inv.lock.Lock()
+	if delay == inv.delay {
+		inv.lock.Unlock()
+		return
+	}
+	old := inv.dci
+	inv.dci = inv.newDCI(delay)
+	inv.delay = delay
+	inv.lock.Unlock()
+
+	// new requests already go to the new invoker, the old one is stopped (it has no pending requests afterwards)
+	pending := old.HasPendingRequests()
+	old.CancelPendingRequests()
+	if pending {
+		inv.Request()
+	}
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUploadInvokerSetDelayDuringExecution(t *testing.T) {
+	active := atomic.Int32{}
+	maxActive := atomic.Int32{}
+	executions := atomic.Int32{}
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	action := func() {
+		n := active.Add(1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		executions.Add(1)
+		started <- struct{}{}
+		<-release
+		active.Add(-1)
+	}
+
+	inv := newUploadInvoker(action, 1*time.Second, func(bool) {})
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() { defer wg.Done(); inv.run() }() // execution of the old invoker
+	<-started
+
+	inv.SetDelay(2 * time.Second)
+
+	go func() { defer wg.Done(); inv.run() }() // execution of the new invoker
+
+	time.Sleep(100 * time.Millisecond)
+	if n := executions.Load(); n != 1 {
+		t.Errorf("second execution started while the first one is still running (%d executions)", n)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := executions.Load(); n != 2 {
+		t.Errorf("expected 2 executions, got %d", n)
+	}
+	if m := maxActive.Load(); m != 1 {
+		t.Errorf("executions overlapped (max %d at the same time)", m)
+	}
+}
@@ -0,0 +1,195 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/cryptext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+)
+
+var InvalidDatabaseError = errors.New("Invalid database file")
+
+const (
+	kdbxSignature1 uint32 = 0x9AA2D903
+	kdbxSignature2 uint32 = 0xB54BFB67
+)
+
+const (
+	kdbxHeaderEnd                 byte = 0
+	kdbxHeaderCipherID            byte = 2
+	kdbxHeaderCompressionFlags    byte = 3
+	kdbxHeaderMasterSeed          byte = 4
+	kdbxHeaderTransformSeed       byte = 5
+	kdbxHeaderTransformRounds     byte = 6
+	kdbxHeaderEncryptionIV        byte = 7
+	kdbxHeaderProtectedStreamKey  byte = 8
+	kdbxHeaderStreamStartBytes    byte = 9
+	kdbxHeaderInnerRandomStreamID byte = 10
+	kdbxHeaderKdfParameters       byte = 11
+)
+
+var (
+	kdbxCipherAES256  = []byte{0x31, 0xc1, 0xf2, 0xe6, 0xbf, 0x71, 0x43, 0x50, 0xbe, 0x58, 0x05, 0x21, 0x6a, 0xfc, 0x5a, 0xff}
+	kdbxCipherTwofish = []byte{0xad, 0x68, 0xf2, 0x9f, 0x57, 0x6f, 0x4b, 0xb9, 0xa3, 0x6a, 0xd4, 0x7a, 0xf9, 0x65, 0x34, 0x6c}
+)
+
+// validateKDBX checks that bin looks like a complete KeePass (KDBX 2.x - 4.x) database.
+// It verifies the signature, the format version, the structure of the outer header
+// and (for KDBX 4) the header hash and the HMAC block stream, which detects truncated files.
+// The database is not decrypted, so the header HMAC and the payload content are not verified.
+func validateKDBX(bin []byte) error {
+	if len(bin) < 12 {
+		return exerr.New(exerr.TypeInternal, fmt.Sprintf("file too short (%d bytes)", len(bin))).Build()
+	}
+
+	sig1 := binary.LittleEndian.Uint32(bin[0:4])
+	sig2 := binary.LittleEndian.Uint32(bin[4:8])
+	if sig1 != kdbxSignature1 || sig2 != kdbxSignature2 {
+		return exerr.New(exerr.TypeInternal, fmt.Sprintf("invalid file signature (0x%08X / 0x%08X)", sig1, sig2)).Build()
+	}
+
+	version := binary.LittleEndian.Uint32(bin[8:12])
+	major := version >> 16
+	minor := version & 0xFFFF
+	if major < 2 || major > 4 {
+		return exerr.New(exerr.TypeInternal, fmt.Sprintf("unsupported KDBX version %d.%d", major, minor)).Build()
+	}
+
+	fields := make(map[byte][]byte)
+
+	pos := 12
+	for {
+		var id byte
+		var size int
+
+		if major >= 4 {
+			if pos+5 > len(bin) {
+				return exerr.New(exerr.TypeInternal, "header is truncated").Build()
+			}
+			id = bin[pos]
+			size = int(binary.LittleEndian.Uint32(bin[pos+1 : pos+5]))
+			pos += 5
+		} else {
+			if pos+3 > len(bin) {
+				return exerr.New(exerr.TypeInternal, "header is truncated").Build()
+			}
+			id = bin[pos]
+			size = int(binary.LittleEndian.Uint16(bin[pos+1 : pos+3]))
+			pos += 3
+		}
+
+		if size < 0 || pos+size > len(bin) {
+			return exerr.New(exerr.TypeInternal, fmt.Sprintf("header field %d is truncated", id)).Build()
+		}
+
+		if _, ok := fields[id]; ok {
+			return exerr.New(exerr.TypeInternal, fmt.Sprintf("duplicate header field %d", id)).Build()
+		}
+		fields[id] = bin[pos : pos+size]
+
+		pos += size
+
+		if id == kdbxHeaderEnd {
+			break
+		}
+	}
+	headerEnd := pos
+
+	required := []byte{kdbxHeaderCipherID, kdbxHeaderCompressionFlags, kdbxHeaderMasterSeed, kdbxHeaderEncryptionIV}
+	if major >= 4 {
+		required = append(required, kdbxHeaderKdfParameters)
+	} else {
+		required = append(required, kdbxHeaderTransformSeed, kdbxHeaderTransformRounds, kdbxHeaderProtectedStreamKey, kdbxHeaderStreamStartBytes, kdbxHeaderInnerRandomStreamID)
+	}
+	for _, id := range required {
+		if _, ok := fields[id]; !ok {
+			return exerr.New(exerr.TypeInternal, fmt.Sprintf("missing required header field %d", id)).Build()
+		}
+	}
+
+	if len(fields[kdbxHeaderCipherID]) != 16 {
+		return exerr.New(exerr.TypeInternal, "invalid cipher id").Build()
+	}
+	if len(fields[kdbxHeaderMasterSeed]) != 32 {
+		return exerr.New(exerr.TypeInternal, "invalid master seed").Build()
+	}
+
+	if major >= 4 {
+
+		// header is followed by SHA-256(header) and HMAC-SHA-256(header)
+		if headerEnd+64 > len(bin) {
+			return exerr.New(exerr.TypeInternal, "header hash is truncated").Build()
+		}
+
+		hash := sha256.Sum256(bin[:headerEnd])
+		if !bytes.Equal(hash[:], bin[headerEnd:headerEnd+32]) {
+			return exerr.New(exerr.TypeInternal, "header hash mismatch (header is corrupted)").Build()
+		}
+
+		// payload is a stream of [hmac:32][size:4][data:size] blocks, terminated by an empty block
+		pos = headerEnd + 64
+		for {
+			if pos+36 > len(bin) {
+				return exerr.New(exerr.TypeInternal, "payload is truncated (missing final block)").Build()
+			}
+			size := int64(binary.LittleEndian.Uint32(bin[pos+32 : pos+36]))
+			pos += 36
+
+			if size == 0 {
+				break
+			}
+			if int64(pos)+size > int64(len(bin)) {
+				return exerr.New(exerr.TypeInternal, "payload is truncated").Build()
+			}
+			pos += int(size)
+		}
+
+		if pos != len(bin) {
+			return exerr.New(exerr.TypeInternal, fmt.Sprintf("unexpected %d bytes after final payload block", len(bin)-pos)).Build()
+		}
+
+	} else {
+
+		payload := len(bin) - headerEnd
+		if payload < 32 {
+			return exerr.New(exerr.TypeInternal, "payload is truncated").Build()
+		}
+
+		cipher := fields[kdbxHeaderCipherID]
+		if (bytes.Equal(cipher, kdbxCipherAES256) || bytes.Equal(cipher, kdbxCipherTwofish)) && payload%16 != 0 {
+			return exerr.New(exerr.TypeInternal, "payload is truncated (not a multiple of the cipher block size)").Build()
+		}
+
+	}
+
+	return nil
+}
+
+// rejectInvalidDatabase keeps a copy of a file that failed validateKDBX (for diagnosis) and informs the user.
+func (app *Application) rejectInvalidDatabase(op *syncOp, bin []byte, action string, verr error) {
+	op.LogError(fmt.Sprintf("Refusing to %s - file is not a valid KeePass database", action), verr)
+
+	fp := path.Join(app.cfg().WorkDir, fmt.Sprintf("kpsync.rejected.%s.%s", time.Now().Format("20060102_150405"), cryptext.BytesSha256(bin)[:8]))
+
+	err := os.WriteFile(fp, bin, 0600)
+	if err != nil {
+		op.LogError("Failed to save copy of rejected file", err)
+		fp = ""
+	} else {
+		op.LogInfo(fmt.Sprintf("Saved copy of rejected file to '%s'", fp))
+	}
+
+	body := fmt.Sprintf("Refusing to %s:\nThe file is not a valid KeePass database (%s).", action, verr.Error())
+	if fp != "" {
+		body += fmt.Sprintf("\nA copy was saved to %s", fp)
+	}
+
+	app.showErrorNotification("KeePassSync: Invalid database", body)
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+type kdbxTestField struct {
+	id   byte
+	data []byte
+}
+
+func kdbxTestHeader(major uint16, fields []kdbxTestField) []byte {
+	buf := bytes.Buffer{}
+	_ = binary.Write(&buf, binary.LittleEndian, kdbxSignature1)
+	_ = binary.Write(&buf, binary.LittleEndian, kdbxSignature2)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(major)<<16|1)
+
+	for _, f := range fields {
+		buf.WriteByte(f.id)
+		if major >= 4 {
+			_ = binary.Write(&buf, binary.LittleEndian, uint32(len(f.data)))
+		} else {
+			_ = binary.Write(&buf, binary.LittleEndian, uint16(len(f.data)))
+		}
+		buf.Write(f.data)
+	}
+
+	return buf.Bytes()
+}
+
+func kdbxTestFields4() []kdbxTestField {
+	return []kdbxTestField{
+		{kdbxHeaderCipherID, kdbxCipherAES256},
+		{kdbxHeaderCompressionFlags, []byte{1, 0, 0, 0}},
+		{kdbxHeaderMasterSeed, make([]byte, 32)},
+		{kdbxHeaderEncryptionIV, make([]byte, 16)},
+		{kdbxHeaderKdfParameters, []byte{0, 1}},
+		{kdbxHeaderEnd, []byte{'\r', '\n', '\r', '\n'}},
+	}
+}
+
+func kdbxTestFields3() []kdbxTestField {
+	return []kdbxTestField{
+		{kdbxHeaderCipherID, kdbxCipherAES256},
+		{kdbxHeaderCompressionFlags, []byte{1, 0, 0, 0}},
+		{kdbxHeaderMasterSeed, make([]byte, 32)},
+		{kdbxHeaderTransformSeed, make([]byte, 32)},
+		{kdbxHeaderTransformRounds, make([]byte, 8)},
+		{kdbxHeaderEncryptionIV, make([]byte, 16)},
+		{kdbxHeaderProtectedStreamKey, make([]byte, 32)},
+		{kdbxHeaderStreamStartBytes, make([]byte, 32)},
+		{kdbxHeaderInnerRandomStreamID, []byte{2, 0, 0, 0}},
+		{kdbxHeaderEnd, []byte{'\r', '\n', '\r', '\n'}},
+	}
+}
+
+// kdbxTestFile4 builds a structurally valid KDBX 4 file (header, header hash/HMAC and the given payload blocks + final block)
+func kdbxTestFile4(fields []kdbxTestField, blocks ...[]byte) []byte {
+	hdr := kdbxTestHeader(4, fields)
+	hash := sha256.Sum256(hdr)
+
+	buf := bytes.Buffer{}
+	buf.Write(hdr)
+	buf.Write(hash[:])
+	buf.Write(make([]byte, 32)) // header HMAC (not verified)
+
+	for _, b := range append(blocks, []byte{}) {
+		buf.Write(make([]byte, 32)) // block HMAC (not verified)
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+
+	return buf.Bytes()
+}
+
+func TestValidateKDBX(t *testing.T) {
+	valid4 := kdbxTestFile4(kdbxTestFields4(), make([]byte, 100), make([]byte, 7))
+	valid3 := append(kdbxTestHeader(3, kdbxTestFields3()), make([]byte, 64)...)
+
+	corruptHash := bytes.Clone(valid4)
+	corruptHash[len(kdbxTestHeader(4, kdbxTestFields4()))] ^= 0xFF
+
+	badSignature := bytes.Clone(valid4)
+	badSignature[0] = 0
+
+	tests := []struct {
+		name    string
+		bin     []byte
+		wantErr bool
+	}{
+		{"kdbx 4", valid4, false},
+		{"kdbx 4 without payload blocks", kdbxTestFile4(kdbxTestFields4()), false},
+		{"kdbx 3.1", valid3, false},
+		{"empty", []byte{}, true},
+		{"too short", valid4[:8], true},
+		{"invalid signature", badSignature, true},
+		{"unsupported version", append(kdbxTestHeader(5, nil), make([]byte, 64)...), true},
+		{"kdbx 4 truncated header", valid4[:40], true},
+		{"kdbx 4 header hash mismatch", corruptHash, true},
+		{"kdbx 4 truncated payload", valid4[:len(valid4)-40], true},
+		{"kdbx 4 missing final block", valid4[:len(valid4)-36], true},
+		{"kdbx 4 trailing bytes", append(bytes.Clone(valid4), 0, 0), true},
+		{"kdbx 4 missing kdf parameters", kdbxTestFile4(append(kdbxTestFields4()[:4], kdbxTestFields4()[5])), true},
+		{"kdbx 4 invalid master seed", kdbxTestFile4([]kdbxTestField{kdbxTestFields4()[0], kdbxTestFields4()[1], {kdbxHeaderMasterSeed, make([]byte, 8)}, kdbxTestFields4()[3], kdbxTestFields4()[4], kdbxTestFields4()[5]}), true},
+		{"kdbx 4 duplicate field", kdbxTestFile4(append([]kdbxTestField{{kdbxHeaderCipherID, kdbxCipherAES256}}, kdbxTestFields4()...)), true},
+		{"kdbx 3.1 payload not block aligned", append(kdbxTestHeader(3, kdbxTestFields3()), make([]byte, 40)...), true},
+		{"kdbx 3.1 payload too short", append(kdbxTestHeader(3, kdbxTestFields3()), make([]byte, 16)...), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateKDBX(tt.bin)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateKDBX() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/cmdext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+	"git.blackforestbytes.com/BlackForestBytes/goext/syncext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/timeext"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+const (
+	keepassHandoffTimeout = 5 * time.Second
+	keepassTermTimeout    = 5 * time.Second
+	keepassCrashRuntime   = 60 * time.Second // a non-zero exit within this time after the start is treated as a crash
+)
+
+// runKeepass runs keepassxc until it exits (and restarts it after a crash, if the user wants to)
+func (app *Application) runKeepass(fallback bool) {
+	for {
+		restart := app.runKeepassProcess(fallback)
+		if !restart {
+			return
+		}
+
+		app.LogInfo("Restarting keepassxc...")
+	}
+}
+
+// runKeepassProcess starts keepassxc once and waits for it to exit, returns true if it should be restarted
+func (app *Application) runKeepassProcess(fallback bool) bool {
+	app.LogInfo("Starting keepassxc...")
+
+	filePath := app.dbFile
+	if fallback {
+		if app.cfg().LocalFallback == nil {
+			app.LogError("No local fallback database configured", nil)
+			app.sigErrChan <- exerr.New(exerr.TypeInternal, "No local fallback database configured").Build()
+			return false
+		}
+
+		filePath = *app.cfg().LocalFallback
+	}
+
+	cmd, err := app.buildLauncherCommand(filePath)
+	if err != nil {
+		app.LogError("Failed to build launcher command", err)
+		app.sigErrChan <- exerr.Wrap(err, "Failed to build launcher command").Build()
+		return false
+	}
+
+	secret := app.applyUnlock(cmd, filePath, fallback)
+	defer wipeSecret(secret)
+
+	var secretPipe io.WriteCloser = nil
+	if secret != nil {
+		secretPipe, err = cmd.StdinPipe()
+		if err != nil {
+			app.LogError("Failed to create stdin pipe for keepassxc", err)
+			app.sigErrChan <- exerr.Wrap(err, "Failed to create stdin pipe").Build()
+			return false
+		}
+	}
+
+	stderrTail := newTailBuffer(8 * 1024)
+	cmd.Stderr = stderrTail
+
+	app.LogDebug(fmt.Sprintf("Launcher command: %v", cmd.Args))
+
+	app.checkLauncherAccess(filePath)
+
+	bgStop := make(chan bool, 128)
+	terminateRequested := syncext.NewAtomicBool(false)
+	exited := syncext.NewAtomicBool(false)
+
+	go func() {
+		select {
+		case <-bgStop:
+			return
+		case <-app.sigTermKeepassChan:
+			terminateRequested.Set(true)
+			app.LogInfo("Received signal to terminate keepassxc")
+			if cmd != nil && cmd.Process != nil {
+				app.stopKeepassGracefully(cmd.Process.Pid, exited.Get)
+			} else {
+				app.LogInfo("No keepassxc process to terminate")
+			}
+		}
+	}()
+
+	err = cmd.Start()
+	if err != nil {
+		app.LogError("Failed to start keepassxc", err)
+		app.sigErrChan <- exerr.Wrap(err, "Failed to start keepassxc").Build()
+		return false
+	}
+
+	app.LogInfo(fmt.Sprintf("keepassxc started with PID %d", cmd.Process.Pid))
+	app.LogLine()
+
+	app.setKeepassPID(cmd.Process.Pid)
+	defer app.setKeepassPID(0)
+
+	tStart := time.Now()
+
+	if secretPipe != nil {
+		err = writeSecret(secretPipe, secret)
+		if err != nil {
+			app.LogError("Failed to pass master password to keepassxc", err)
+		}
+		wipeSecret(secret)
+	}
+
+	err = cmd.Wait()
+
+	exited.Set(true)
+	bgStop <- true
+
+	exitErr := &exec.ExitError{}
+	if errors.As(err, &exitErr) {
+
+		runtime := time.Since(tStart)
+
+		desc := fmt.Sprintf("exit code %d", exitErr.ExitCode())
+		crashed := runtime < keepassCrashRuntime
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			desc = fmt.Sprintf("killed by signal %s", ws.Signal())
+			crashed = ws.Signal() != syscall.SIGTERM && ws.Signal() != syscall.SIGINT && ws.Signal() != syscall.SIGHUP // (stopped by the user or the session)
+		}
+
+		if crashed && !terminateRequested.Get() {
+			return app.handleKeepassCrash(fallback, desc, runtime, stderrTail.String())
+		}
+
+		if !terminateRequested.Get() && stderrTail.String() != "" {
+			app.LogDebug("keepassxc stderr (tail):\n" + stderrTail.String())
+		}
+
+		app.LogInfo(fmt.Sprintf("keepass exited with %s", desc))
+		app.sigKPExitChan <- true
+		return false
+
+	}
+
+	if err != nil {
+		app.LogError("Failed to run keepassxc", err)
+		app.sigErrChan <- exerr.Wrap(err, "Failed to run keepassxc").Build()
+		return false
+	}
+
+	if time.Since(tStart) < keepassHandoffTimeout {
+		// keepassxc is single-instance, a second process passes the database to the running one and exits immediately
+		for _, p := range app.preexistingKeepass {
+			if running, err := p.IsRunning(); err == nil && running {
+				app.LogInfo(fmt.Sprintf("keepassxc exited immediately - database was (probably) handed over to the running instance (PID %d), attaching to it", p.Pid))
+				app.LogLine()
+				app.trackKeepassProcess(p)
+				return false
+			}
+		}
+	}
+
+	app.LogInfo("keepassxc exited successfully")
+	app.LogLine()
+
+	app.sigKPExitChan <- true
+	return false
+
+}
+
+// handleKeepassCrash reports an unexpected keepassxc exit and asks the user whether to restart it (returns true to restart)
+func (app *Application) handleKeepassCrash(fallback bool, desc string, runtime time.Duration, stderr string) bool {
+	app.LogError(fmt.Sprintf("keepassxc crashed (%s) after running for %s", desc, runtime.Round(time.Second)), nil)
+	if stderr != "" {
+		app.LogError("keepassxc stderr (tail):\n"+stderr, nil)
+	}
+
+	if !fallback {
+		_, err := app.snapshotDatabase("crash")
+		if err != nil {
+			app.LogError("Failed to create snapshot of database", err)
+		}
+	}
+
+	// the notification blocks until the user answers, kpsync must still be able to shut down in the meantime
+	choice := make(chan string, 1)
+	go func() {
+		r, err := app.showChoiceNotification("KeePassSync: KeePassXC crashed", fmt.Sprintf("KeePassXC crashed (%s).\nRestart it on the same database?", desc), map[string]string{"r": "Restart", "q": "Quit"})
+		if err != nil {
+			app.LogError("Failed to show choice notification", err)
+		}
+		choice <- r
+	}()
+
+	var r string
+	select {
+	case r = <-choice:
+	case <-app.sigTermKeepassChan:
+		app.LogInfo("Received signal to terminate keepassxc - not restarting it")
+		return false
+	}
+
+	if r == "r" {
+		app.LogInfo("Crash decision: [Restart] - restarting keepassxc")
+		app.LogLine()
+		return true
+	}
+
+	app.LogInfo("Crash decision: [Quit] - stopping")
+	app.LogLine()
+
+	app.sigKPExitChan <- true
+	return false
+}
+
+// trackKeepassProcess follows the lifetime of a keepassxc process that was not started by us.
+// The process is never stopped by us (it belongs to the user and may have other databases open).
+func (app *Application) trackKeepassProcess(p *process.Process) {
+	app.LogInfo(fmt.Sprintf("Tracking running keepassxc (PID %d)", p.Pid))
+	app.LogLine()
+
+	app.setKeepassPID(int(p.Pid))
+	defer app.setKeepassPID(0)
+
+	for {
+		select {
+		case <-app.sigTermKeepassChan:
+			app.LogInfo(fmt.Sprintf("Received signal to terminate keepassxc - not stopping keepassxc (PID %d), it was not started by kpsync", p.Pid))
+			return
+
+		case <-time.After(1 * time.Second):
+			running, err := p.IsRunning()
+			if err != nil || !running {
+				app.LogInfo(fmt.Sprintf("keepassxc (PID %d) exited", p.Pid))
+				app.LogLine()
+				app.sigKPExitChan <- true
+				return
+			}
+		}
+	}
+}
+
+// stopKeepassGracefully asks keepassxc to quit (so it can save / ask the user to save pending changes),
+// waits up to config.ShutdownGrace for it to exit, and only then sends SIGTERM and finally SIGKILL
+func (app *Application) stopKeepassGracefully(pid int, hasExited func() bool) {
+	waitExit := func(timeout time.Duration) bool {
+		t0 := time.Now()
+		for time.Since(t0) < timeout {
+			if hasExited() {
+				return true
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+		return hasExited()
+	}
+
+	grace := app.shutdownGrace()
+
+	app.LogInfo(fmt.Sprintf("Asking keepassxc %d to quit (grace period: %s)", pid, grace))
+
+	if app.requestKeepassExit(pid) {
+		if waitExit(grace) {
+			app.LogInfo("keepassxc exited gracefully")
+			return
+		}
+		app.LogWarn(fmt.Sprintf("keepassxc did not exit within %s", grace))
+	}
+
+	app.LogInfo(fmt.Sprintf("Terminating keepassxc %d (SIGTERM)", pid))
+	err := syscall.Kill(pid, syscall.SIGTERM)
+	if errors.Is(err, syscall.ESRCH) {
+		app.LogInfo("keepassxc already terminated")
+		return
+	} else if err != nil {
+		app.LogError("Failed to terminate keepassxc", err)
+	}
+
+	if waitExit(keepassTermTimeout) {
+		app.LogInfo("keepassxc terminated successfully")
+		return
+	}
+
+	app.LogWarn(fmt.Sprintf("keepassxc did not react to SIGTERM within %s - killing it (SIGKILL)", keepassTermTimeout))
+	err = syscall.Kill(pid, syscall.SIGKILL)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		app.LogError("Failed to kill keepassxc", err)
+	}
+}
+
+// requestKeepassExit politely asks keepassxc to quit, via D-Bus or (fallback) by closing its window.
+// Returns false if no request could be sent.
+func (app *Application) requestKeepassExit(pid int) bool {
+	if commandExists("dbus-send") {
+		res, err := cmdext.
+			Runner("dbus-send").
+			Arg("--session").
+			Arg("--print-reply").
+			Arg("--dest=org.keepassxc.KeePassXC.MainWindow").
+			Arg("/keepassxc").
+			Arg("org.keepassxc.KeePassXC.MainWindow.appExit").
+			Run()
+		if err == nil && res.ExitCode == 0 {
+			app.LogDebug("Sent appExit request to keepassxc via D-Bus")
+			return true
+		}
+		if err != nil {
+			app.LogDebug("D-Bus appExit request failed: " + err.Error())
+		} else {
+			app.LogDebug(fmt.Sprintf("D-Bus appExit request failed (exit code %d): %s", res.ExitCode, strings.TrimSpace(res.StdErr)))
+		}
+	}
+
+	if commandExists("wmctrl") {
+		res, err := cmdext.Runner("wmctrl").Arg("-l").Arg("-p").Run()
+		if err == nil && res.ExitCode == 0 {
+			closed := false
+			for _, line := range strings.Split(res.StdOut, "\n") {
+				fields := strings.Fields(line)
+				if len(fields) < 3 || fields[2] != strconv.Itoa(pid) {
+					continue
+				}
+				if r, err := cmdext.Runner("wmctrl").Arg("-i").Arg("-c").Arg(fields[0]).Run(); err == nil && r.ExitCode == 0 {
+					app.LogDebug(fmt.Sprintf("Closed keepassxc window %s via wmctrl", fields[0]))
+					closed = true
+				}
+			}
+			if closed {
+				return true
+			}
+		}
+	}
+
+	app.LogDebug("Could not ask keepassxc to quit politely (no D-Bus / no window found)")
+	return false
+}
+
+func (app *Application) shutdownGrace() time.Duration {
+	if app.cfg().ShutdownGrace <= 0 {
+		return 30 * time.Second
+	}
+	return timeext.FromMilliseconds(app.cfg().ShutdownGrace)
+}
+
+// launchKeepass (re-)starts keepassxc on the synced database, used in resident mode after keepassxc was closed
+func (app *Application) launchKeepass() {
+	app.masterLock.Lock()
+	if app.keepassRunning.Get() {
+		app.masterLock.Unlock()
+		app.LogInfo("keepassxc is already running")
+		return
+	}
+	app.keepassRunning.Set(true)
+	app.masterLock.Unlock()
+
+	app.setTrayOpenKeepassEnabled(false)
+
+	go func() {
+		defer app.keepassRunning.Set(false)
+		app.runKeepass(false)
+	}()
+}
+
+func (app *Application) setKeepassPID(pid int) {
+	app.masterLock.Lock()
+	defer app.masterLock.Unlock()
+
+	app.keepassPID = pid
+}
+
+// showKeepass brings the keepassxc window to the front (or starts keepassxc in resident mode)
+func (app *Application) showKeepass() {
+	app.masterLock.Lock()
+	pid := app.keepassPID
+	app.masterLock.Unlock()
+
+	if pid == 0 {
+		if app.cfg().Resident && !app.cfg().NoLaunch && app.syncReady.Get() {
+			app.launchKeepass()
+		} else {
+			app.LogInfo("keepassxc is not running - nothing to show")
+		}
+		return
+	}
+
+	if !commandExists("wmctrl") {
+		app.LogWarn("Can't show keepassxc window - wmctrl not found")
+		return
+	}
+
+	res, err := cmdext.Runner("wmctrl").Arg("-l").Arg("-p").Run()
+	if err != nil || res.ExitCode != 0 {
+		app.LogError("Failed to list windows via wmctrl", err)
+		return
+	}
+
+	for _, line := range strings.Split(res.StdOut, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pid) {
+			continue
+		}
+		if r, err := cmdext.Runner("wmctrl").Arg("-i").Arg("-a").Arg(fields[0]).Run(); err == nil && r.ExitCode == 0 {
+			app.LogDebug(fmt.Sprintf("Activated keepassxc window %s via wmctrl", fields[0]))
+			return
+		}
+	}
+
+	app.LogWarn(fmt.Sprintf("No window of keepassxc (PID %d) found", pid))
+}
@@ -0,0 +1,326 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/cmdext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+)
+
+type LauncherConfig struct {
+	Command      string            `json:"command"`       // command template, {db} is replaced with the database path (appended if missing)
+	Args         []string          `json:"args"`          // extra arguments, inserted before the database path
+	Env          map[string]string `json:"env"`           // additional environment variables
+	WorkingDir   string            `json:"working_dir"`   // working directory of the launched process
+	ProcessNames []string          `json:"process_names"` // process names of a running instance (derived from command if empty)
+}
+
+const defaultLauncherCommand = "keepassxc {db}"
+
+func (app *Application) launcherConfig() LauncherConfig {
+	if app.cfg().Launcher == nil || strings.TrimSpace(app.cfg().Launcher.Command) == "" {
+		lc := LauncherConfig{Command: defaultLauncherCommand}
+		if app.cfg().Launcher != nil {
+			lc.Args = app.cfg().Launcher.Args
+			lc.Env = app.cfg().Launcher.Env
+			lc.WorkingDir = app.cfg().Launcher.WorkingDir
+			lc.ProcessNames = app.cfg().Launcher.ProcessNames
+		}
+		return lc
+	}
+	return *app.cfg().Launcher
+}
+
+// buildLauncherCommand creates the command to open dbPath in the configured password-manager
+func (app *Application) buildLauncherCommand(dbPath string) (*exec.Cmd, error) {
+	lc := app.launcherConfig()
+
+	tokens, err := splitCommandLine(lc.Command)
+	if err != nil {
+		return nil, exerr.Wrap(err, "Failed to parse launcher command").Str("command", lc.Command).Build()
+	}
+	if len(tokens) == 0 {
+		return nil, exerr.New(exerr.TypeInternal, "Launcher command is empty").Build()
+	}
+
+	args := make([]string, 0, len(tokens)+len(lc.Args)+1)
+	hasDB := false
+	for i, t := range tokens {
+		if strings.Contains(t, "{db}") {
+			if !hasDB {
+				args = append(args, lc.Args...)
+			}
+			hasDB = true
+			t = strings.ReplaceAll(t, "{db}", dbPath)
+		}
+		if i > 0 {
+			args = append(args, t)
+		}
+	}
+	if !hasDB {
+		args = append(args, lc.Args...)
+		args = append(args, dbPath)
+	}
+
+	cmd := exec.Command(tokens[0], args...)
+
+	if len(lc.Env) > 0 {
+		cmd.Env = os.Environ()
+		for k, v := range lc.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+
+	if lc.WorkingDir != "" {
+		cmd.Dir = expandHome(lc.WorkingDir)
+	}
+
+	return cmd, nil
+}
+
+// launcherProcessNames returns the (lowercase) process names that identify a running instance of the configured launcher
+func (app *Application) launcherProcessNames() []string {
+	lc := app.launcherConfig()
+
+	if len(lc.ProcessNames) > 0 {
+		res := make([]string, 0, len(lc.ProcessNames))
+		for _, v := range lc.ProcessNames {
+			res = append(res, strings.ToLower(v))
+		}
+		return res
+	}
+
+	if lc.Command == defaultLauncherCommand {
+		return []string{"keepassxc", "keepass"}
+	}
+
+	tokens, err := splitCommandLine(lc.Command)
+	if err != nil || len(tokens) == 0 {
+		return []string{}
+	}
+
+	if appID := flatpakAppID(tokens); appID != "" {
+		return []string{strings.ToLower(appID[strings.LastIndex(appID, ".")+1:])}
+	}
+
+	return []string{strings.ToLower(path.Base(tokens[0]))}
+}
+
+// launcherIsKeepassXC returns true if the configured launcher starts keepassxc (directly or as flatpak)
+func (app *Application) launcherIsKeepassXC() bool {
+	tokens, err := splitCommandLine(app.launcherConfig().Command)
+	if err != nil || len(tokens) == 0 {
+		return false
+	}
+
+	if appID := flatpakAppID(tokens); appID != "" {
+		return strings.EqualFold(appID, "org.keepassxc.KeePassXC")
+	}
+
+	return strings.HasPrefix(strings.ToLower(path.Base(tokens[0])), "keepassxc")
+}
+
+// checkLauncherAccess verifies (best-effort) that a sandboxed (flatpak) launcher can access dbPath
+func (app *Application) checkLauncherAccess(dbPath string) {
+	tokens, err := splitCommandLine(app.launcherConfig().Command)
+	if err != nil {
+		return
+	}
+
+	appID := flatpakAppID(tokens)
+	if appID == "" {
+		return
+	}
+
+	res, err := cmdext.Runner("flatpak").Arg("info").Arg("--show-permissions").Arg(appID).Run()
+	if err != nil || res.ExitCode != 0 {
+		app.LogError(fmt.Sprintf("Failed to query flatpak permissions of '%s'", appID), err)
+		return
+	}
+
+	filesystems := make([]string, 0)
+	for _, line := range strings.Split(res.StdOut, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "filesystems="); ok {
+			filesystems = append(filesystems, strings.Split(v, ";")...)
+		}
+	}
+
+	if flatpakPathReachable(filesystems, dbPath) {
+		app.LogDebug(fmt.Sprintf("Database path '%s' is reachable from flatpak sandbox '%s'", dbPath, appID))
+		return
+	}
+
+	dir := path.Dir(dbPath)
+
+	app.LogError(fmt.Sprintf("Database path '%s' is (probably) not reachable from the flatpak sandbox of '%s' (filesystems: %v)", dbPath, appID, filesystems), nil)
+	app.LogInfo(fmt.Sprintf("Fix: flatpak override --user --filesystem=%s %s", dir, appID))
+	app.showErrorNotification("KeePassSync: Launcher", fmt.Sprintf("The flatpak '%s' probably can't access '%s'.\nRun: flatpak override --user --filesystem=%s %s", appID, dir, dir, appID))
+}
+
+// flatpakAppID returns the app-id of a `flatpak run [options] {app-id} ...` command (or "" if it is no flatpak command)
+func flatpakAppID(tokens []string) string {
+	if len(tokens) < 3 || path.Base(tokens[0]) != "flatpak" {
+		return ""
+	}
+
+	for i := 1; i < len(tokens); i++ {
+		if tokens[i] != "run" {
+			continue
+		}
+		for _, t := range tokens[i+1:] {
+			if !strings.HasPrefix(t, "-") {
+				return t
+			}
+		}
+	}
+
+	return ""
+}
+
+func flatpakPathReachable(filesystems []string, fp string) bool {
+	home := ""
+	if usr, err := user.Current(); err == nil {
+		home = usr.HomeDir
+	}
+
+	xdgDirs := map[string]string{
+		"xdg-config":       envOrDefault("XDG_CONFIG_HOME", path.Join(home, ".config")),
+		"xdg-cache":        envOrDefault("XDG_CACHE_HOME", path.Join(home, ".cache")),
+		"xdg-data":         envOrDefault("XDG_DATA_HOME", path.Join(home, ".local/share")),
+		"xdg-run":          os.Getenv("XDG_RUNTIME_DIR"),
+		"xdg-desktop":      path.Join(home, "Desktop"),
+		"xdg-documents":    path.Join(home, "Documents"),
+		"xdg-download":     path.Join(home, "Downloads"),
+		"xdg-music":        path.Join(home, "Music"),
+		"xdg-pictures":     path.Join(home, "Pictures"),
+		"xdg-public-share": path.Join(home, "Public"),
+		"xdg-templates":    path.Join(home, "Templates"),
+		"xdg-videos":       path.Join(home, "Videos"),
+	}
+
+	if abs, err := filepath.EvalSymlinks(path.Dir(fp)); err == nil {
+		fp = path.Join(abs, path.Base(fp))
+	}
+
+	for _, fs := range filesystems {
+		fs = strings.TrimSpace(fs)
+		if fs == "" || strings.HasPrefix(fs, "!") {
+			continue
+		}
+		if idx := strings.LastIndex(fs, ":"); idx > 0 {
+			fs = fs[:idx] // strip :ro / :rw / :create
+		}
+
+		root := ""
+		if fs == "host" {
+			return true
+		} else if fs == "home" {
+			root = home
+		} else if fs == "~" || strings.HasPrefix(fs, "~/") {
+			root = path.Join(home, strings.TrimPrefix(fs, "~"))
+		} else if strings.HasPrefix(fs, "/") {
+			root = fs
+		} else {
+			name, sub, _ := strings.Cut(fs, "/")
+			if dir, ok := xdgDirs[name]; ok && dir != "" {
+				root = path.Join(dir, sub)
+			}
+		}
+
+		if root != "" && (fp == root || strings.HasPrefix(fp, strings.TrimSuffix(root, "/")+"/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitCommandLine splits a command into arguments (whitespace separated, supports '...', "..." and \-escapes)
+func splitCommandLine(v string) ([]string, error) {
+	res := make([]string, 0)
+
+	curr := strings.Builder{}
+	inToken := false
+	quote := rune(0)
+	escaped := false
+
+	for _, c := range v {
+		if escaped {
+			curr.WriteRune(c)
+			escaped = false
+			continue
+		}
+
+		if c == '\\' && quote != '\'' {
+			escaped = true
+			inToken = true
+			continue
+		}
+
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			} else {
+				curr.WriteRune(c)
+			}
+			continue
+		}
+
+		if c == '"' || c == '\'' {
+			quote = c
+			inToken = true
+			continue
+		}
+
+		if c == ' ' || c == '\t' || c == '\n' {
+			if inToken {
+				res = append(res, curr.String())
+				curr.Reset()
+				inToken = false
+			}
+			continue
+		}
+
+		curr.WriteRune(c)
+		inToken = true
+	}
+
+	if quote != 0 {
+		return nil, exerr.New(exerr.TypeInternal, "unterminated quote in command").Build()
+	}
+	if escaped {
+		return nil, exerr.New(exerr.TypeInternal, "trailing backslash in command").Build()
+	}
+
+	if inToken {
+		res = append(res, curr.String())
+	}
+
+	return res, nil
+}
+
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return p
+	}
+
+	return path.Join(usr.HomeDir, strings.TrimPrefix(p, "~"))
+}
+
+func envOrDefault(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
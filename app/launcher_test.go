@@ -0,0 +1,96 @@
+package app
+
+import (
+	"os/user"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", []string{}, false},
+		{"whitespace only", " \t\n", []string{}, false},
+		{"single", "keepassxc", []string{"keepassxc"}, false},
+		{"args", "keepassxc --minimized {db}", []string{"keepassxc", "--minimized", "{db}"}, false},
+		{"multiple spaces", "  keepassxc   {db}  ", []string{"keepassxc", "{db}"}, false},
+		{"double quotes", `keepassxc "/home/me/My Passwords/{db}"`, []string{"keepassxc", "/home/me/My Passwords/{db}"}, false},
+		{"single quotes", `sh -c 'exec keepassxc "$1"'`, []string{"sh", "-c", `exec keepassxc "$1"`}, false},
+		{"escaped space", `keepassxc /tmp/my\ db.kdbx`, []string{"keepassxc", "/tmp/my db.kdbx"}, false},
+		{"escape in double quotes", `echo "a\"b"`, []string{"echo", `a"b`}, false},
+		{"no escape in single quotes", `echo 'a\b'`, []string{"echo", `a\b`}, false},
+		{"empty quoted arg", `cmd "" x`, []string{"cmd", "", "x"}, false},
+		{"adjacent quotes", `cmd a"b c"d`, []string{"cmd", "ab cd"}, false},
+		{"unterminated double quote", `keepassxc "{db}`, nil, true},
+		{"unterminated single quote", `keepassxc '{db}`, nil, true},
+		{"trailing backslash", `keepassxc \`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitCommandLine(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitCommandLine(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitCommandLine(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlatpakPathReachable(t *testing.T) {
+	usr, err := user.Current()
+	if err != nil {
+		t.Skip("no current user: " + err.Error())
+	}
+	home := usr.HomeDir
+
+	t.Setenv("XDG_CONFIG_HOME", "/kpsync-test/config")
+	t.Setenv("XDG_CACHE_HOME", "")
+	t.Setenv("XDG_RUNTIME_DIR", "/kpsync-test/run")
+
+	inHome := path.Join(home, "kpsync-test-missing", "db.kdbx")
+	inCache := path.Join(home, ".cache", "kpsync-test-missing", "db.kdbx")
+	inDocs := path.Join(home, "Documents", "kpsync-test-missing", "db.kdbx")
+
+	tests := []struct {
+		name        string
+		filesystems []string
+		fp          string
+		want        bool
+	}{
+		{"no filesystems", nil, inHome, false},
+		{"host", []string{"host"}, "/kpsync-test/db.kdbx", true},
+		{"home", []string{"home"}, inHome, true},
+		{"home read-only", []string{"home:ro"}, inHome, true},
+		{"home does not include other dirs", []string{"home"}, "/kpsync-test/db.kdbx", false},
+		{"negated", []string{"!home"}, inHome, false},
+		{"tilde subdir", []string{"~/kpsync-test-missing"}, inHome, true},
+		{"tilde other subdir", []string{"~/other"}, inHome, false},
+		{"absolute", []string{"/kpsync-test"}, "/kpsync-test/work/db.kdbx", true},
+		{"absolute with trailing slash", []string{"/kpsync-test/"}, "/kpsync-test/work/db.kdbx", true},
+		{"absolute prefix is not a parent", []string{"/kpsync-te"}, "/kpsync-test/work/db.kdbx", false},
+		{"xdg-config from env", []string{"xdg-config"}, "/kpsync-test/config/kpsync/db.kdbx", true},
+		{"xdg-config subdir", []string{"xdg-config/kpsync:create"}, "/kpsync-test/config/kpsync/db.kdbx", true},
+		{"xdg-config other subdir", []string{"xdg-config/other"}, "/kpsync-test/config/kpsync/db.kdbx", false},
+		{"xdg-cache default", []string{"xdg-cache"}, inCache, true},
+		{"xdg-run", []string{"xdg-run"}, "/kpsync-test/run/db.kdbx", true},
+		{"xdg-documents", []string{"xdg-documents"}, inDocs, true},
+		{"unknown xdg dir", []string{"xdg-unknown"}, inHome, false},
+		{"multiple", []string{"xdg-documents", "/kpsync-test", ""}, "/kpsync-test/db.kdbx", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := flatpakPathReachable(tt.filesystems, tt.fp); got != tt.want {
+				t.Errorf("flatpakPathReachable(%q, %q) = %v, want %v", tt.filesystems, tt.fp, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+)
+
+// InstanceLockedError is returned by acquireInstanceLock if another (live) kpsync process uses the work dir
+var InstanceLockedError = errors.New("work dir is locked by another kpsync instance")
+
+// acquireInstanceLock takes an exclusive flock on {work_dir}/kpsync.lock and writes our PID into it.
+// If the lock is held by another process InstanceLockedError and the PID of the owner are returned.
+// The lock is released by the kernel when the process dies, so a lock file left over by a crashed process is simply re-used.
+func (app *Application) acquireInstanceLock() (int, error) {
+	err := os.MkdirAll(app.cfg().WorkDir, os.ModePerm)
+	if err != nil {
+		return 0, exerr.Wrap(err, "").Build()
+	}
+
+	fp := path.Join(app.cfg().WorkDir, "kpsync.lock")
+
+	f, err := os.OpenFile(fp, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, exerr.Wrap(err, "Failed to open lock file").Str("path", fp).Build()
+	}
+
+	prevPID := readLockPID(f)
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		_ = f.Close()
+		return prevPID, InstanceLockedError
+	}
+	if err != nil {
+		_ = f.Close()
+		return 0, exerr.Wrap(err, "Failed to lock lock file").Str("path", fp).Build()
+	}
+
+	if prevPID > 0 && prevPID != os.Getpid() {
+		app.LogInfo(fmt.Sprintf("Recovered stale lock of (crashed) kpsync process %d", prevPID))
+	}
+
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		_ = f.Sync()
+	}
+
+	app.lockFile = f
+
+	app.LogDebug(fmt.Sprintf("Acquired instance lock '%s'", fp))
+
+	return 0, nil
+}
+
+func (app *Application) releaseInstanceLock() {
+	if app.lockFile == nil {
+		return
+	}
+
+	_ = app.lockFile.Truncate(0)
+	_ = syscall.Flock(int(app.lockFile.Fd()), syscall.LOCK_UN)
+	_ = app.lockFile.Close()
+	app.lockFile = nil
+}
+
+func readLockPID(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// handleRunningInstance is called if another instance already uses our work dir,
+// it asks the user what to do and signals the other instance (SIGUSR1 = sync now, SIGUSR2 = show keepassxc)
+func (app *Application) handleRunningInstance(pid int) {
+	app.LogWarn(fmt.Sprintf("kpsync is already running with work dir '%s' (PID %d) - not starting a second instance", app.cfg().WorkDir, pid))
+
+	if pid <= 0 || syscall.Kill(pid, 0) != nil {
+		app.LogError("Could not determine the PID of the running instance", nil)
+		app.showErrorNotification("KeePassSync", fmt.Sprintf("kpsync is already running with work dir '%s'.", app.cfg().WorkDir))
+		return
+	}
+
+	r, err := app.showChoiceNotification("KeePassSync", fmt.Sprintf("kpsync is already running (PID %d).", pid), map[string]string{"o": "Show KeePassXC", "s": "Sync now", "c": "Cancel"})
+	if err != nil {
+		app.LogError("Failed to show choice notification", err)
+		return
+	}
+
+	var sig syscall.Signal
+	if r == "o" {
+		sig = syscall.SIGUSR2
+	} else if r == "s" {
+		sig = syscall.SIGUSR1
+	} else {
+		app.LogInfo("Running-instance decision: [Cancel]")
+		return
+	}
+
+	app.LogInfo(fmt.Sprintf("Sending %s to running instance (PID %d)", sig, pid))
+	if err := syscall.Kill(pid, sig); err != nil {
+		app.LogError("Failed to signal running instance", err)
+	}
+}
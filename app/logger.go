@@ -5,6 +5,8 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -14,11 +16,80 @@ import (
 	"git.blackforestbytes.com/BlackForestBytes/goext/termext"
 )
 
+type LogLevel string //@enum:type
+
+const (
+	LogLevelDebug LogLevel = "debug"
+	LogLevelInfo  LogLevel = "info"
+	LogLevelWarn  LogLevel = "warn"
+	LogLevelError LogLevel = "error"
+)
+
+var logLevelOrder = []LogLevel{LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError}
+
+const logTimeFormat = "2006-01-02 15:04:05"
+
 type LogMessage struct {
-	Line      int
+	Line      int // 0 = first line of a message, >0 = continuation line (multi-line messages, fields)
 	Prefix    string
 	Message   string
 	ColorFunc func(string) string
+	Time      time.Time
+	Component string // webdav | watcher | tray | keepass | sync | ...  (derived from the calling source file)
+	OpID      string // ID of the sync operation that was running when the message was logged (see beginOperation)
+}
+
+// Text returns the (uncolored) line as written to the log file
+func (m LogMessage) Text() string {
+	if m.Prefix == "" {
+		return ""
+	}
+
+	ts := m.Time.Format(logTimeFormat)
+	if m.Line == 0 {
+		return ts + " " + m.Prefix + " " + m.Message
+	}
+	return langext.StrRepeat(" ", len(ts)+1+len(m.Prefix)+1) + m.Message
+}
+
+// LogField is a structured value attached to a log message (written as an own line to the human-readable log
+// and as a field to the JSON log)
+type LogField struct {
+	Key   string
+	Value any
+	Debug bool // only logged if log_level is debug (details of an info message)
+}
+
+func F(key string, value any) LogField {
+	return LogField{Key: key, Value: value}
+}
+
+// FD is a field that is only logged if log_level is debug
+func FD(key string, value any) LogField {
+	return LogField{Key: key, Value: value, Debug: true}
+}
+
+// components of the log messages, by source file (everything else is "app")
+var logComponents = map[string]string{
+	"webdav.go":        "webdav",
+	"watcher.go":       "watcher",
+	"tray.go":          "tray",
+	"keepass.go":       "keepass",
+	"launcher.go":      "keepass",
+	"unlock.go":        "keepass",
+	"sync.go":          "sync",
+	"snapshot.go":      "sync",
+	"filecheck.go":     "sync",
+	"kdbx.go":          "sync",
+	"control.go":       "control",
+	"config.go":        "config",
+	"configcheck.go":   "config",
+	"configwatch.go":   "config",
+	"notifications.go": "notify",
+	"exec.go":          "exec",
+	"commands.go":      "cli",
+	"doctor.go":        "cli",
+	"wizard.go":        "cli",
 }
 
 func colDefault(v string) string {
@@ -26,72 +97,135 @@ func colDefault(v string) string {
 }
 
 func (app *Application) LogFatal(msg string) {
-	app.logInternal("[F]", msg, termext.Red)
+	app.logInternal("[F]", msg, termext.Red, nil, "")
 	panic(0)
 }
 
 func (app *Application) LogFatalErr(msg string, err error) {
-	if err != nil {
-		app.logInternal("[F]", msg+"\n"+err.Error()+"\n"+exerr.FromError(err).FormatLog(exerr.LogPrintOverview), termext.Red)
-	} else {
-		app.logInternal("[F]", msg, termext.Red)
-	}
-
+	app.logInternal("[F]", errorLogMessage(msg, err), termext.Red, nil, "")
 	panic(0)
 }
 
 func (app *Application) LogError(msg string, err error) {
-	if err != nil {
-		app.logInternal("[E]", msg+"\n"+err.Error()+"\n"+exerr.FromError(err).FormatLog(exerr.LogPrintOverview), termext.Red)
-	} else {
-		app.logInternal("[E]", msg, termext.Red)
-	}
+	app.logInternal("[E]", errorLogMessage(msg, err), termext.Red, nil, "")
+}
+
+func (app *Application) LogErrorWith(msg string, err error, fields ...LogField) {
+	app.logInternal("[E]", errorLogMessage(msg, err), termext.Red, fields, "")
 }
 
 func (app *Application) LogWarn(msg string) {
-	app.logInternal("[W]", msg, termext.Red)
+	if !app.logLevelEnabled(LogLevelWarn) {
+		return
+	}
+	app.logInternal("[W]", msg, termext.Red, nil, "")
+}
+
+func (app *Application) LogWarnWith(msg string, fields ...LogField) {
+	if !app.logLevelEnabled(LogLevelWarn) {
+		return
+	}
+	app.logInternal("[W]", msg, termext.Red, fields, "")
 }
 
 func (app *Application) LogInfo(msg string) {
-	app.logInternal("[I]", msg, colDefault)
+	if !app.logLevelEnabled(LogLevelInfo) {
+		return
+	}
+	app.logInternal("[I]", msg, colDefault, nil, "")
+}
+
+func (app *Application) LogInfoWith(msg string, fields ...LogField) {
+	if !app.logLevelEnabled(LogLevelInfo) {
+		return
+	}
+	app.logInternal("[I]", msg, colDefault, fields, "")
 }
 
 func (app *Application) LogDebug(msg string) {
-	app.logInternal("[D]", msg, termext.Gray)
+	if !app.logLevelEnabled(LogLevelDebug) {
+		return
+	}
+	app.logInternal("[D]", msg, termext.Gray, nil, "")
 }
 
-func (app *Application) logInternal(pf string, msg string, cf func(_ string) string) {
+func (app *Application) LogDebugWith(msg string, fields ...LogField) {
+	if !app.logLevelEnabled(LogLevelDebug) {
+		return
+	}
+	app.logInternal("[D]", msg, termext.Gray, fields, "")
+}
+
+func errorLogMessage(msg string, err error) string {
+	if err == nil {
+		return msg
+	}
+	return msg + "\n" + err.Error() + "\n" + exerr.FromError(err).FormatLog(exerr.LogPrintOverview)
+}
+
+// logLevelEnabled returns false if messages of this level are suppressed by config.log_level
+// (everything is logged until the config is loaded)
+func (app *Application) logLevelEnabled(lvl LogLevel) bool {
+	minIdx := slices.Index(logLevelOrder, LogLevel(app.cfg().LogLevel))
+	if minIdx < 0 {
+		return true
+	}
+	return slices.Index(logLevelOrder, lvl) >= minIdx
+}
+
+// logInternal must only be called directly by the Log* methods (the component is derived from their caller)
+func (app *Application) logInternal(pf string, msg string, cf func(_ string) string, fields []LogField, opID string) {
+	component := "app"
+	if _, file, _, ok := runtime.Caller(2); ok {
+		if c, ok := logComponents[path.Base(file)]; ok {
+			component = c
+		}
+	}
+
 	app.logLock.Lock()
 	defer app.logLock.Unlock()
 
+	now := time.Now()
+
+	msg = app.redact(msg)
+
+	if !app.logLevelEnabled(LogLevelDebug) {
+		fields = slices.DeleteFunc(slices.Clone(fields), func(f LogField) bool { return f.Debug })
+	}
+
+	fieldValues := make([]string, len(fields))
+	for i, f := range fields {
+		fieldValues[i] = app.redact(formatLogValue(f.Value))
+	}
+
 	c := cf
 
-	if !termext.SupportsColors() && !app.config.ForceColors {
+	if !termext.SupportsColors() && !app.cfg().ForceColors {
 		c = func(s string) string { return s }
 	}
 
-	for i, s := range strings.Split(msg, "\n") {
-		if i == 0 {
-			println(c(pf + " " + s))
-			app.logList = append(app.logList, LogMessage{i, pf, s, cf})
-			if app.logFile != nil {
-				_, err := app.logFile.WriteString(pf + " " + s + "\n")
-				if err != nil {
-					app.fallbackLog("[!] Failed to write logfile: " + err.Error())
-				}
-			}
-			app.logBroadcaster.Publish("", LogMessage{i, pf, s, cf})
-		} else {
-			println(c(langext.StrRepeat(" ", len(pf)+1) + s))
-			app.logList = append(app.logList, LogMessage{i, pf, s, cf})
-			if app.logFile != nil {
-				_, err := app.logFile.WriteString(langext.StrRepeat(" ", len(pf)+1) + s + "\n")
-				if err != nil {
-					app.fallbackLog("[!] Failed to write logfile: " + err.Error())
-				}
+	lines := strings.Split(msg, "\n")
+
+	keyWidth := 0
+	for _, f := range fields {
+		keyWidth = max(keyWidth, len(f.Key))
+	}
+	for i, f := range fields {
+		lines = append(lines, f.Key+langext.StrRepeat(" ", keyWidth-len(f.Key))+" := "+fieldValues[i])
+	}
+
+	for i, s := range lines {
+		lm := LogMessage{Line: i, Prefix: pf, Message: s, ColorFunc: cf, Time: now, Component: component, OpID: opID}
+
+		println(c(lm.Text()))
+		app.logList = append(app.logList, lm)
+		if app.logFile != nil {
+			_, err := app.logFile.WriteString(lm.Text() + "\n")
+			if err != nil {
+				app.fallbackLog("[!] Failed to write logfile: " + err.Error())
 			}
-			app.logBroadcaster.Publish("", LogMessage{i, pf, s, cf})
 		}
+		app.logBroadcaster.Publish("", lm)
 	}
 
 	if app.logFile != nil {
@@ -100,6 +234,15 @@ func (app *Application) logInternal(pf string, msg string, cf func(_ string) str
 			app.fallbackLog("[!] Failed to flush logfile: " + err.Error())
 		}
 	}
+
+	app.writeJSONLog(jsonLogRecord{
+		Time:      now.Format(time.RFC3339Nano),
+		Level:     logLevelNames[pf],
+		Component: component,
+		OpID:      opID,
+		Message:   msg,
+		Fields:    jsonLogFields(fields, fieldValues),
+	})
 }
 
 func (app *Application) LogLine() {
@@ -119,13 +262,15 @@ func (app *Application) LogLine() {
 		}
 	}
 
-	app.logList = append(app.logList, LogMessage{0, "", "", func(v string) string { return v }})
+	app.logList = append(app.logList, LogMessage{ColorFunc: colDefault})
 
-	app.logBroadcaster.Publish("", LogMessage{0, "", "", func(v string) string { return v }})
+	app.logBroadcaster.Publish("", LogMessage{ColorFunc: colDefault})
 }
 
 func (app *Application) fallbackLog(s string) {
-	if termext.SupportsColors() || app.config.ForceColors {
+	s = app.redact(s)
+
+	if termext.SupportsColors() || app.cfg().ForceColors {
 		s = termext.Red(s)
 	}
 
@@ -137,7 +282,7 @@ func (app *Application) writeOutStartupLogs() {
 	defer app.logLock.Unlock()
 
 	for _, v := range app.logList {
-		_, err := app.logFile.WriteString(v.Prefix + " " + v.Message + "\n")
+		_, err := app.logFile.WriteString(v.Text() + "\n")
 		if err != nil {
 			app.fallbackLog("[!] Failed to write logfile: " + err.Error())
 		}
@@ -149,8 +294,97 @@ func (app *Application) writeOutStartupLogs() {
 	}
 }
 
+// syncOp is a running sync operation (download, upload, pull, ...), see beginOperation.
+// Messages logged via its Log* methods carry its ID (`op` in the JSON log),
+// the functions that are part of an operation get it passed as their first parameter.
+type syncOp struct {
+	app  *Application
+	ID   string
+	Kind string
+	t0   time.Time
+}
+
+// beginOperation starts a new sync operation with an own ID, the caller must call End() when it is finished
+func (app *Application) beginOperation(kind string) *syncOp {
+	op := &syncOp{app: app, ID: langext.RandBase62(12), Kind: kind, t0: time.Now()}
+
+	op.LogDebugWith("Operation started", F("operation", kind))
+
+	return op
+}
+
+func (op *syncOp) End() {
+	op.LogDebugWith("Operation finished", F("operation", op.Kind), F("duration", time.Since(op.t0)))
+}
+
+func (op *syncOp) LogError(msg string, err error) {
+	op.app.logInternal("[E]", errorLogMessage(msg, err), termext.Red, nil, op.ID)
+}
+
+func (op *syncOp) LogErrorWith(msg string, err error, fields ...LogField) {
+	op.app.logInternal("[E]", errorLogMessage(msg, err), termext.Red, fields, op.ID)
+}
+
+func (op *syncOp) LogWarn(msg string) {
+	if !op.app.logLevelEnabled(LogLevelWarn) {
+		return
+	}
+	op.app.logInternal("[W]", msg, termext.Red, nil, op.ID)
+}
+
+func (op *syncOp) LogWarnWith(msg string, fields ...LogField) {
+	if !op.app.logLevelEnabled(LogLevelWarn) {
+		return
+	}
+	op.app.logInternal("[W]", msg, termext.Red, fields, op.ID)
+}
+
+func (op *syncOp) LogInfo(msg string) {
+	if !op.app.logLevelEnabled(LogLevelInfo) {
+		return
+	}
+	op.app.logInternal("[I]", msg, colDefault, nil, op.ID)
+}
+
+func (op *syncOp) LogInfoWith(msg string, fields ...LogField) {
+	if !op.app.logLevelEnabled(LogLevelInfo) {
+		return
+	}
+	op.app.logInternal("[I]", msg, colDefault, fields, op.ID)
+}
+
+func (op *syncOp) LogDebug(msg string) {
+	if !op.app.logLevelEnabled(LogLevelDebug) {
+		return
+	}
+	op.app.logInternal("[D]", msg, termext.Gray, nil, op.ID)
+}
+
+func (op *syncOp) LogDebugWith(msg string, fields ...LogField) {
+	if !op.app.logLevelEnabled(LogLevelDebug) {
+		return
+	}
+	op.app.logInternal("[D]", msg, termext.Gray, fields, op.ID)
+}
+
+// formatLogValue formats a field value for the human-readable log
+func formatLogValue(v any) string {
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case time.Time:
+		return vv.Format(time.RFC3339)
+	case time.Duration:
+		return vv.String()
+	case error:
+		return vv.Error()
+	default:
+		return fmt.Sprintf("%v", vv)
+	}
+}
+
 func (app *Application) openLogFile() {
-	err := exec.Command("xdg-open", path.Join(app.config.WorkDir, "kpsync.log")).Start()
+	err := exec.Command("xdg-open", path.Join(app.cfg().WorkDir, "kpsync.log")).Start()
 	if err != nil {
 		app.LogError("Failed to open log file with xdg-open", err)
 		return
@@ -158,10 +392,10 @@ func (app *Application) openLogFile() {
 }
 
 func (app *Application) openLogFifo() {
-	filePath := path.Join(app.config.WorkDir, fmt.Sprintf("kpsync.%s.fifo", langext.RandBase62(8)))
+	filePath := path.Join(app.cfg().WorkDir, fmt.Sprintf("kpsync.%s.fifo", langext.RandBase62(8)))
 
 	app.LogDebug(fmt.Sprintf("Creating fifo file at '%s'", filePath))
-	err := syscall.Mkfifo(filePath, 0640)
+	err := syscall.Mkfifo(filePath, 0600)
 	if err != nil {
 		app.LogError("Failed to create fifo file", err)
 		return
@@ -185,20 +419,12 @@ func (app *Application) openLogFifo() {
 		app.LogDebug(fmt.Sprintf("Initializing fifo with %d past entries", len(app.logList)))
 		app.logLock.Lock()
 		for _, item := range app.logList {
-			if item.Line == 0 {
-				_, _ = f.WriteString(item.ColorFunc(item.Prefix+" "+item.Message) + "\n")
-			} else {
-				_, _ = f.WriteString(item.ColorFunc(langext.StrRepeat(" ", len(item.Prefix)+1)+item.Message) + "\n")
-			}
+			_, _ = f.WriteString(item.ColorFunc(item.Text()) + "\n")
 		}
 		app.logLock.Unlock()
 
 		sub := app.logBroadcaster.SubscribeByCallback("", func(msg LogMessage) {
-			if msg.Line == 0 {
-				_, _ = f.WriteString(msg.ColorFunc(msg.Prefix+" "+msg.Message) + "\n")
-			} else {
-				_, _ = f.WriteString(msg.ColorFunc(langext.StrRepeat(" ", len(msg.Prefix)+1)+msg.Message) + "\n")
-			}
+			_, _ = f.WriteString(msg.ColorFunc(msg.Text()) + "\n")
 		})
 		defer sub.Unsubscribe()
 
@@ -213,8 +439,8 @@ func (app *Application) openLogFifo() {
 
 	time.Sleep(100 * time.Millisecond)
 
-	te := strings.Split(app.config.TerminalEmulator, " ")[0]
-	tc := strings.Split(app.config.TerminalEmulator, " ")[1:]
+	te := strings.Split(app.cfg().TerminalEmulator, " ")[0]
+	tc := strings.Split(app.cfg().TerminalEmulator, " ")[1:]
 	tc = append(tc, fmt.Sprintf("cat \"%s\"", filePath))
 	//tc = append(tc, "bash")
 
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+const jsonLogBacklogSize = 4096 // max messages kept until the config (and with it log_json) is loaded
+
+var logLevelNames = map[string]string{
+	"[D]": "debug",
+	"[I]": "info",
+	"[W]": "warn",
+	"[E]": "error",
+	"[F]": "fatal",
+}
+
+// jsonLogRecord is one line of the JSON log (config.log_json)
+type jsonLogRecord struct {
+	Time      string         `json:"time"`
+	Level     string         `json:"level"`
+	Component string         `json:"component"`
+	OpID      string         `json:"op,omitempty"`
+	Message   string         `json:"msg"`
+	Fields    map[string]any `json:"fields,omitempty"`
+}
+
+// openJSONLog opens the JSON-lines log (appending) and writes the messages that were logged before the config was loaded
+func (app *Application) openJSONLog(fp string) {
+	app.logLock.Lock()
+	defer app.logLock.Unlock()
+
+	backlog := app.jsonLogBacklog
+	app.jsonLogBacklog = nil
+	app.jsonLogDecided = true
+
+	if fp == "" || app.jsonLogFile != nil {
+		return
+	}
+
+	f, err := os.OpenFile(expandHome(fp), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		app.fallbackLog("[!] Failed to open JSON log: " + err.Error()) // LogError would dead-lock (logLock)
+		return
+	}
+
+	app.jsonLogFile = f
+
+	for _, rec := range backlog {
+		app.writeJSONLog(rec)
+	}
+}
+
+func (app *Application) closeJSONLog() {
+	app.logLock.Lock()
+	defer app.logLock.Unlock()
+
+	if app.jsonLogFile == nil {
+		return
+	}
+
+	if err := app.jsonLogFile.Close(); err != nil {
+		app.fallbackLog("[!] Failed to close JSON log: " + err.Error())
+	}
+	app.jsonLogFile = nil
+}
+
+// writeJSONLog writes rec to the JSON log, must be called with logLock held
+func (app *Application) writeJSONLog(rec jsonLogRecord) {
+	if app.jsonLogFile == nil {
+		if !app.jsonLogDecided && len(app.jsonLogBacklog) < jsonLogBacklogSize {
+			app.jsonLogBacklog = append(app.jsonLogBacklog, rec)
+		}
+		return
+	}
+
+	bin, err := json.Marshal(rec)
+	if err != nil {
+		app.fallbackLog("[!] Failed to encode JSON log record: " + err.Error())
+		return
+	}
+
+	if _, err := app.jsonLogFile.Write(append(bin, '\n')); err != nil {
+		app.fallbackLog("[!] Failed to write JSON log: " + err.Error())
+	}
+}
+
+// jsonLogFields converts the fields of a message, numbers stay numbers (durations in ms), everything else is the (redacted) string
+func jsonLogFields(fields []LogField, values []string) map[string]any {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	res := make(map[string]any, len(fields))
+	for i, f := range fields {
+		switch v := f.Value.(type) {
+		case int, int64, uint64, float64, bool:
+			res[f.Key] = v
+		case time.Duration:
+			res[f.Key] = v.Milliseconds()
+		default:
+			res[f.Key] = values[i]
+		}
+	}
+	return res
+}
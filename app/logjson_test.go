@@ -0,0 +1,34 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJSONLogFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []LogField
+		values []string
+		want   map[string]any
+	}{
+		{"no fields", nil, nil, nil},
+		{"string", []LogField{F("etag", "6543f1c2a")}, []string{"6543f1c2a"}, map[string]any{"etag": "6543f1c2a"}},
+		{"redacted string", []LogField{F("url", "https://bob:pw@h/db.kdbx")}, []string{"https://********@h/db.kdbx"}, map[string]any{"url": "https://********@h/db.kdbx"}},
+		{"int64", []LogField{F("size", int64(48213))}, []string{"48213"}, map[string]any{"size": int64(48213)}},
+		{"int", []LogField{F("status", 412)}, []string{"412"}, map[string]any{"status": 412}},
+		{"bool", []LogField{F("forced", true)}, []string{"true"}, map[string]any{"forced": true}},
+		{"duration in ms", []LogField{F("duration", 1500*time.Millisecond)}, []string{"1.5s"}, map[string]any{"duration": int64(1500)}},
+		{"time as string", []LogField{F("last_modified", time.Date(2026, 10, 19, 17, 16, 11, 0, time.UTC))}, []string{"2026-10-19T17:16:11Z"}, map[string]any{"last_modified": "2026-10-19T17:16:11Z"}},
+		{"multiple", []LogField{F("etag", "x"), F("size", int64(1))}, []string{"x", "1"}, map[string]any{"etag": "x", "size": int64(1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jsonLogFields(tt.fields, tt.values); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jsonLogFields() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
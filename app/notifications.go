@@ -9,6 +9,11 @@ import (
 )
 
 func (app *Application) showErrorNotification(msg string, body string) {
+	if app.headless {
+		app.LogDebug("{notify-send} (headless, not shown) " + msg)
+		return
+	}
+
 	app.LogDebug("{notify-send} " + msg)
 
 	res, err := cmdext.
@@ -36,6 +41,15 @@ func (app *Application) showErrorNotification(msg string, body string) {
 }
 
 func (app *Application) showSuccessNotification(msg string, body string) {
+	if app.headless {
+		app.LogDebug("{notify-send} (headless, not shown) " + msg)
+		return
+	}
+	if !app.cfg().NotifySuccess {
+		app.LogDebug("{notify-send} (notify_success=false, not shown) " + msg)
+		return
+	}
+
 	app.LogDebug("{notify-send} " + msg)
 
 	res, err := cmdext.
@@ -62,7 +76,13 @@ func (app *Application) showSuccessNotification(msg string, body string) {
 	app.LogDebug(fmt.Sprintf("Displayed notification with id %s", res.StdOut))
 }
 
+// showChoiceNotification asks the user via notify-send, returns the key of the chosen option ("" if dismissed or headless)
 func (app *Application) showChoiceNotification(msg string, body string, options map[string]string) (string, error) {
+	if app.headless {
+		app.LogWarn(fmt.Sprintf("Can't ask the user in headless mode (%s) - treating as dismissed", msg))
+		return "", nil
+	}
+
 	app.LogDebug(fmt.Sprintf("{notify-send} %s {%d choices}", msg, len(options)))
 
 	bldr := cmdext.
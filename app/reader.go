@@ -2,7 +2,9 @@ package app
 
 import (
 	"io"
+	"strings"
 	"sync"
+	"time"
 )
 
 type teeReadCloser struct {
@@ -43,3 +45,53 @@ func NewProgressReader(r io.Reader, totalBytes int64, onProgress func(done, tota
 
 	return &teeReadCloser{r: io.TeeReader(r, pw), c: io.NopCloser(r)}
 }
+
+// idleTimeoutReader resets timer after every read, the timer cancels the request if no data arrives for the timeout
+type idleTimeoutReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleTimeoutReader(r io.Reader, timer *time.Timer, timeout time.Duration) io.Reader {
+	return &idleTimeoutReader{r: r, timer: timer, timeout: timeout}
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.timer.Reset(ir.timeout)
+	}
+	return n, err
+}
+
+// tailBuffer is an io.Writer that only keeps the last {max} bytes written to it
+type tailBuffer struct {
+	sync.Mutex
+
+	max int
+	buf []byte
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max, buf: make([]byte, 0, max)}
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	tb.buf = append(tb.buf, p...)
+	if len(tb.buf) > tb.max {
+		tb.buf = tb.buf[len(tb.buf)-tb.max:]
+	}
+
+	return len(p), nil
+}
+
+func (tb *tailBuffer) String() string {
+	tb.Lock()
+	defer tb.Unlock()
+
+	return strings.TrimSpace(string(tb.buf))
+}
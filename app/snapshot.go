@@ -0,0 +1,76 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
+)
+
+// snapshotDatabase copies the current local database into {WorkDir}/snapshots and returns the path of the copy
+func (app *Application) snapshotDatabase(reason string) (string, error) {
+	bin, err := os.ReadFile(app.dbFile)
+	if err != nil {
+		return "", exerr.Wrap(err, "Failed to read database file").Build()
+	}
+
+	return app.writeSnapshot(reason, "local", bin)
+}
+
+// snapshotRemoteDatabase downloads the current remote database into {WorkDir}/snapshots (before it is overwritten)
+// and returns the path of the copy
+func (app *Application) snapshotRemoteDatabase(op *syncOp, reason string) (string, error) {
+	bin, err := app.fetchRemoteDatabase(op)
+	if err != nil {
+		return "", exerr.Wrap(err, "Failed to download remote database").Build()
+	}
+
+	return app.writeSnapshot(reason, "remote", bin)
+}
+
+func (app *Application) writeSnapshot(reason string, origin string, bin []byte) (string, error) {
+	dir := path.Join(app.cfg().WorkDir, "snapshots")
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", exerr.Wrap(err, "Failed to create snapshot directory").Build()
+	}
+
+	// {time}.{origin}.{reason}.{db} - a counter is appended if there is already a snapshot with this name (same millisecond)
+	base := fmt.Sprintf("%s.%s.%s", time.Now().Format("20060102_150405.000"), origin, reason)
+
+	fp := ""
+	for i := 0; ; i++ {
+		fp = path.Join(dir, base+"."+path.Base(app.dbFile))
+		if i > 0 {
+			fp = path.Join(dir, fmt.Sprintf("%s.%d.%s", base, i, path.Base(app.dbFile)))
+		}
+
+		f, err := os.OpenFile(fp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", exerr.Wrap(err, "Failed to create snapshot").Build()
+		}
+
+		_, err = f.Write(bin)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(fp)
+			return "", exerr.Wrap(err, "Failed to write snapshot").Build()
+		}
+
+		break
+	}
+
+	app.LogInfo(fmt.Sprintf("Saved snapshot of %s database to '%s' (%s)", origin, fp, langext.FormatBytes(int64(len(bin)))))
+
+	return fp, nil
+}
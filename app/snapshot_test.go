@@ -0,0 +1,40 @@
+package app
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWriteSnapshotUniqueNames(t *testing.T) {
+	app := &Application{}
+	app.setConfig(Config{WorkDir: t.TempDir()})
+	app.dbFile = path.Join(app.cfg().WorkDir, "vault.kdbx")
+
+	fpLocal1, err := app.writeSnapshot("before-shrink", "local", []byte("local-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpLocal2, err := app.writeSnapshot("before-shrink", "local", []byte("local-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpRemote, err := app.writeSnapshot("before-shrink", "remote", []byte("remote"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fpLocal1 == fpLocal2 || fpLocal1 == fpRemote || fpLocal2 == fpRemote {
+		t.Fatalf("snapshots overwrite each other (%s, %s, %s)", fpLocal1, fpLocal2, fpRemote)
+	}
+	if !strings.Contains(path.Base(fpRemote), ".remote.before-shrink.") || !strings.HasSuffix(fpRemote, ".vault.kdbx") {
+		t.Errorf("unexpected snapshot name %s", fpRemote)
+	}
+
+	for fp, want := range map[string]string{fpLocal1: "local-1", fpLocal2: "local-2", fpRemote: "remote"} {
+		if bin, err := os.ReadFile(fp); err != nil || string(bin) != want {
+			t.Errorf("snapshot %s = %q (%v), want %q", fp, bin, err, want)
+		}
+	}
+}
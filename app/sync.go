@@ -4,13 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
-	"syscall"
 	"time"
 
 	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
 	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
+	"git.blackforestbytes.com/BlackForestBytes/goext/timeext"
 	"mikescher.com/kpsync/assets"
 )
 
@@ -22,206 +21,183 @@ const (
 	InitSyncResponseAbort    InitSyncResponse = "ABORT"
 )
 
-func (app *Application) initSync() (InitSyncResponse, error) {
-
-	err := os.MkdirAll(app.config.WorkDir, os.ModePerm)
+// initPaths creates the work dir and determines the paths of the database and the state files in it
+func (app *Application) initPaths() error {
+	err := os.MkdirAll(app.cfg().WorkDir, os.ModePerm)
 	if err != nil {
-		return "", exerr.Wrap(err, "").Build()
+		return exerr.Wrap(err, "").Build()
 	}
 
 	fn := ""
-	if app.config.LocalFallback != nil {
-		fn = path.Base(*app.config.LocalFallback)
+	if app.cfg().LocalFallback != nil {
+		fn = path.Base(*app.cfg().LocalFallback)
 	}
 	if fn == "" || fn == "." || fn == "/" || fn == "\\" {
-		fn = path.Base(app.config.WebDAVURL)
+		fn = path.Base(app.cfg().WebDAVURL)
 	}
 	if fn == "" || fn == "." || fn == "/" || fn == "\\" {
 		fn = "database.kdbx"
 	}
 
-	app.dbFile = path.Join(app.config.WorkDir, fn)
-	app.stateFile = path.Join(app.config.WorkDir, "kpsync.state")
+	app.dbFile = path.Join(app.cfg().WorkDir, fn)
+	app.stateFile = path.Join(app.cfg().WorkDir, "kpsync.state")
+	app.partialFile = path.Join(app.cfg().WorkDir, "kpsync.download")
+	app.partialStateFile = path.Join(app.cfg().WorkDir, "kpsync.download.state")
+	app.skippedFile = path.Join(app.cfg().WorkDir, "kpsync.upload-skipped")
 
-	if app.isKeepassRunning() {
-		app.LogError("keepassxc is already running!", nil)
-		app.showErrorNotification("KeePassSync: Error", "An keepassxc instance is already running!\nPlease close it before starting kpsync.")
-		return "", exerr.New(exerr.TypeInternal, "keepassxc is already running").Build()
-	}
+	return nil
+}
 
-	state := app.readState()
+func (app *Application) initSync() (InitSyncResponse, error) {
+	op := app.beginOperation("initial-sync")
+	defer op.End()
 
-	needsDownload := true
+	err := app.initPaths()
+	if err != nil {
+		return "", exerr.Wrap(err, "").Build()
+	}
 
-	if state != nil && fileExists(app.dbFile) {
-		localCS, err := app.calcLocalChecksum()
-		if err != nil {
-			app.LogError("Failed to calculate local database checksum", err)
-		} else if localCS == state.Checksum {
-			remoteETag, remoteLM, err := app.getRemoteState()
-			if err != nil {
-				app.LogError("Failed to get remote ETag", err)
-			} else if remoteETag == state.ETag {
-
-				app.LogInfo(fmt.Sprintf("Found local database matching remote database - skip initial download"))
-				app.LogDebug(fmt.Sprintf("Checksum (cached)     := %s", state.Checksum))
-				app.LogDebug(fmt.Sprintf("Checksum (local)      := %s", localCS))
-				app.LogDebug(fmt.Sprintf("ETag (cached)         := %s", state.ETag))
-				app.LogDebug(fmt.Sprintf("ETag (remote)         := %s", remoteETag))
-				app.LogDebug(fmt.Sprintf("LastModified (cached) := %s", state.LastModified.Format(time.RFC3339)))
-				app.LogDebug(fmt.Sprintf("LastModified (remote) := %s", remoteLM.Format(time.RFC3339)))
-				app.LogLine()
-				needsDownload = false
-
-				err = app.saveState(state.ETag, state.LastModified, state.Checksum, state.Size)
-				if err != nil {
-					app.LogError("Failed to save state", err)
-				}
+	if procs := app.findKeepassProcesses(); len(procs) > 0 {
+		for _, p := range procs {
+			if processUsesFile(p, app.dbFile) {
+				op.LogInfo(fmt.Sprintf("keepassxc is already running with our database (PID %d) - attaching to it", p.Pid))
+				app.attachedKeepass = p
+				break
 			}
 		}
+
+		if app.attachedKeepass == nil {
+			op.LogInfo(fmt.Sprintf("keepassxc is already running (%d instances), but without our database - continuing", len(procs)))
+			app.preexistingKeepass = procs
+		}
 	}
 
-	if needsDownload {
-		err = func() error {
-			fin := app.setTrayState("Downloading database", assets.IconDownload)
-			defer fin()
+	state := app.readState()
 
-			app.LogInfo(fmt.Sprintf("Downloading remote database to %s", app.dbFile))
+	var etagIfNoneMatch *string = nil
 
-			etag, lm, sha, sz, err := app.downloadDatabase()
-			if err != nil {
-				app.LogError("Failed to download remote database", err)
-				return exerr.Wrap(err, "Failed to download remote database").Build()
-			}
+	if state != nil && fileExists(app.dbFile) {
+		localCS, err := app.calcLocalChecksum()
+		if err != nil {
+			op.LogError("Failed to calculate local database checksum", err)
+		} else if localCS == state.Checksum {
+			etagIfNoneMatch = langext.Ptr(state.ETag)
+		} else if app.attachedKeepass != nil {
+			// the database was edited in the running keepassxc while we were not running - a download would overwrite these changes
+			op.LogWarnWith("Attached keepassxc has un-synced local changes - uploading them instead of downloading the remote database", F("checksum_cached", state.Checksum), F("checksum_local", localCS))
+			app.LogLine()
 
-			app.LogInfo(fmt.Sprintf("Downloaded remote database to %s", app.dbFile))
-			app.LogInfo(fmt.Sprintf("Checksum     := %s", sha))
-			app.LogInfo(fmt.Sprintf("ETag         := %s", etag))
-			app.LogInfo(fmt.Sprintf("Size         := %s (%d)", langext.FormatBytes(sz), sz))
-			app.LogInfo(fmt.Sprintf("LastModified := %s", lm.Format(time.RFC3339)))
+			app.uploadOnStart = true
+			return InitSyncResponseOkay, nil
+		} else if fileExists(app.skippedFile) {
+			// the user skipped the upload of these changes (size anomaly) - ask again instead of overwriting them
+			op.LogWarnWith("Local database has un-synced changes (upload was skipped) - uploading them instead of downloading the remote database", F("checksum_cached", state.Checksum), F("checksum_local", localCS))
+			app.LogLine()
 
-			err = app.saveState(etag, lm, sha, sz)
-			if err != nil {
-				app.LogError("Failed to save state", err)
-				return exerr.Wrap(err, "Failed to save state").Build()
-			}
+			app.uploadOnStart = true
+			return InitSyncResponseOkay, nil
+		}
+	} else if app.attachedKeepass != nil && fileExists(app.dbFile) {
+		// no sync state - we can't tell whether the open database has changes, keep a copy before it is replaced
+		if _, err := app.snapshotDatabase("attached"); err != nil {
+			op.LogError("Failed to create snapshot of database", err)
+			return "", exerr.Wrap(err, "Failed to create snapshot of database").Build()
+		}
+	}
 
+	if app.cfg().FastStart && !app.headless && etagIfNoneMatch != nil {
+		if bin, err := os.ReadFile(app.dbFile); err == nil && validateKDBX(bin) == nil {
+			op.LogInfoWith(fmt.Sprintf("Fast start - using cached database %s, checking remote in the background", app.dbFile), F("checksum_cached", state.Checksum), F("etag_cached", state.ETag))
 			app.LogLine()
 
-			return nil
-		}()
-		if err != nil {
+			app.fastStartPending = true
+			return InitSyncResponseOkay, nil
+		}
+	}
 
-			if app.config.LocalFallback != nil {
+	notModified := false
+	invalidDB := false
 
-				r, err := app.showChoiceNotification("KeePassSync", "Failed to download remote database.\nUse local fallback?", map[string]string{"y": "Yes", "n": "Abort"})
-				if err != nil {
-					app.LogError("Failed to show choice notification", err)
-					return "", exerr.Wrap(err, "Failed to show choice notification").Build()
-				}
+	err = func() error {
+		fin := app.setTrayState("Downloading database", assets.IconDownload)
+		defer fin()
 
-				if r == "y" {
-					return InitSyncResponseFallback, nil
-				} else if r == "n" {
-					return InitSyncResponseAbort, nil
-				} else {
-					return "", exerr.Wrap(err, "").Build()
-				}
+		if etagIfNoneMatch != nil {
+			op.LogInfo(fmt.Sprintf("Downloading remote database to %s (if not matching ETag %s)", app.dbFile, *etagIfNoneMatch))
+		} else {
+			op.LogInfo(fmt.Sprintf("Downloading remote database to %s", app.dbFile))
+		}
 
-			} else {
+		etag, lm, sha, sz, err := app.downloadDatabase(op, etagIfNoneMatch)
+		if errors.Is(err, NotModifiedError) {
 
-				app.showErrorNotification("KeePassSync", "Failed to download remote database.")
-				return InitSyncResponseAbort, nil
+			op.LogInfoWith("Found local database matching remote database - skip initial download", FD("checksum_cached", state.Checksum), FD("etag_cached", state.ETag), FD("last_modified_cached", state.LastModified))
+			app.LogLine()
+			notModified = true
 
+			err = app.saveState(state.ETag, state.LastModified, state.Checksum, state.Size)
+			if err != nil {
+				op.LogError("Failed to save state", err)
 			}
 
+			return nil
 		}
-
-		return InitSyncResponseOkay, nil
-
-	} else {
-		app.LogInfo(fmt.Sprintf("Skip download - use existing local database %s", app.dbFile))
-		app.LogLine()
-
-		return InitSyncResponseOkay, nil
-	}
-}
-
-func (app *Application) runKeepass(fallback bool) {
-	app.LogInfo("Starting keepassxc...")
-
-	filePath := app.dbFile
-	if fallback {
-		if app.config.LocalFallback == nil {
-			app.LogError("No local fallback database configured", nil)
-			app.sigErrChan <- exerr.New(exerr.TypeInternal, "No local fallback database configured").Build()
-			return
+		if errors.Is(err, InvalidDatabaseError) {
+			invalidDB = true // already reported by rejectInvalidDatabase
+			return err
+		}
+		if err != nil {
+			op.LogError("Failed to download remote database", err)
+			return exerr.Wrap(err, "Failed to download remote database").Build()
 		}
 
-		filePath = *app.config.LocalFallback
-	}
+		op.LogInfoWith(fmt.Sprintf("Downloaded remote database to %s", app.dbFile), F("checksum", sha), F("etag", etag), F("size", sz), F("last_modified", lm))
 
-	cmd := exec.Command("keepassxc", filePath)
+		err = app.saveState(etag, lm, sha, sz)
+		if err != nil {
+			op.LogError("Failed to save state", err)
+			return exerr.Wrap(err, "Failed to save state").Build()
+		}
 
-	bgStop := make(chan bool, 128)
+		app.LogLine()
 
-	go func() {
-		select {
-		case <-bgStop:
-			return
-		case <-app.sigTermKeepassChan:
-			app.LogInfo("Received signal to terminate keepassxc")
-			if cmd != nil && cmd.Process != nil {
-				app.LogInfo(fmt.Sprintf("Terminating keepassxc %d", cmd.Process.Pid))
-				err := cmd.Process.Signal(syscall.SIGTERM)
-				if errors.Is(err, os.ErrProcessDone) {
-					app.LogInfo("keepassxc already terminated")
-				} else if err != nil {
-					app.LogError("Failed to terminate keepassxc", err)
-				} else {
-					app.LogInfo("keepassxc terminated successfully")
-				}
-			} else {
-				app.LogInfo("No keepassxc process to terminate")
-			}
-		}
+		return nil
 	}()
-
-	err := cmd.Start()
 	if err != nil {
-		app.LogError("Failed to start keepassxc", err)
-		app.sigErrChan <- exerr.Wrap(err, "Failed to start keepassxc").Build()
-		return
-	}
 
-	app.LogInfo(fmt.Sprintf("keepassxc started with PID %d", cmd.Process.Pid))
-	app.LogLine()
+		if app.cfg().LocalFallback != nil && !app.headless {
+
+			r, err := app.showChoiceNotification("KeePassSync", "Failed to download remote database.\nUse local fallback?", map[string]string{"y": "Yes", "n": "Abort"})
+			if err != nil {
+				op.LogError("Failed to show choice notification", err)
+				return "", exerr.Wrap(err, "Failed to show choice notification").Build()
+			}
 
-	err = cmd.Wait()
+			if r == "y" {
+				return InitSyncResponseFallback, nil
+			} else if r == "n" {
+				return InitSyncResponseAbort, nil
+			} else {
+				return "", exerr.Wrap(err, "").Build()
+			}
 
-	bgStop <- true
+		} else {
 
-	exitErr := &exec.ExitError{}
-	if errors.As(err, &exitErr) {
+			if !invalidDB {
+				app.showErrorNotification("KeePassSync", "Failed to download remote database.")
+			}
+			return InitSyncResponseAbort, nil
 
-		app.LogInfo(fmt.Sprintf("keepass exited with code %d", exitErr.ExitCode()))
-		app.sigKPExitChan <- true
-		return
+		}
 
 	}
 
-	if err != nil {
-		app.LogError("Failed to run keepassxc", err)
-		app.sigErrChan <- exerr.Wrap(err, "Failed to run keepassxc").Build()
-		return
+	if notModified {
+		op.LogInfo(fmt.Sprintf("Skip download - use existing local database %s", app.dbFile))
+		app.LogLine()
 	}
 
-	app.LogInfo("keepassxc exited successfully")
-	app.LogLine()
-
-	app.sigKPExitChan <- true
-	return
-
+	return InitSyncResponseOkay, nil
 }
 
 func (app *Application) runDBUpload() {
@@ -230,38 +206,56 @@ func (app *Application) runDBUpload() {
 	app.uploadActive.Set(true)
 	defer app.uploadActive.Set(false)
 
+	op := app.beginOperation("upload")
+	defer op.End()
+
 	fin1 := app.setTrayState("Uploading database", assets.IconUpload)
 	defer fin1()
 
-	app.LogInfo("Starting upload-check")
+	op.LogInfo("Starting upload-check")
+
+	if stable, invalidKDBX, reason := app.waitForStableFile(op); !stable {
+		if invalidKDBX {
+			op.LogWarn("Database file is not valid (" + reason + ")")
+			// continue, uploadDatabase rejects (and reports) the file
+		} else if app.postponeUnstableUpload(op, reason, true) {
+			app.uploadDCI.Request()
+			return
+		}
+	} else {
+		app.resetUploadPostpones()
+	}
 
 	state := app.readState()
 	localCS, err := app.calcLocalChecksum()
 	if err != nil {
-		app.LogError("Failed to calculate local database checksum", err)
+		op.LogError("Failed to calculate local database checksum", err)
 		app.showErrorNotification("KeePassSync: Error", "Failed to calculate local database checksum")
 		return
 	}
 
 	if state != nil && localCS == state.Checksum {
-		app.LogInfo("Local database still matches remote (via checksum) - no need to upload")
-		app.LogInfo(fmt.Sprintf("Checksum (remote/cached) := %s", state.Checksum))
-		app.LogInfo(fmt.Sprintf("Checksum (local)         := %s", localCS))
+		op.LogInfoWith("Local database still matches remote (via checksum) - no need to upload", F("checksum_remote", state.Checksum), F("checksum_local", localCS))
 		return
 	}
 
-	app.doDBUpload(state, fin1, true)
+	if !app.checkUploadSizeAnomaly(op, state) {
+		return
+	}
+
+	app.doDBUpload(op, state, fin1, true)
 }
 
-func (app *Application) doDBUpload(state *State, stateClear func(), allowConflictResolution bool) {
-	app.LogInfo("Uploading database to remote")
+// doDBUpload uploads the local database (conditional on state.ETag), returns nil if remote and local are in sync afterwards
+func (app *Application) doDBUpload(op *syncOp, state *State, stateClear func(), allowConflictResolution bool) error {
+	op.LogInfo("Uploading database to remote")
 
 	var eTagPtr *string = nil
 	if state != nil {
 		eTagPtr = langext.Ptr(state.ETag)
 	}
 
-	etag, lm, sha, sz, err := app.uploadDatabase(eTagPtr)
+	etag, lm, sha, sz, err := app.uploadDatabase(op, eTagPtr)
 	if errors.Is(err, ETagConflictError) && allowConflictResolution {
 
 		stateClear()
@@ -270,99 +264,100 @@ func (app *Application) doDBUpload(state *State, stateClear func(), allowConflic
 
 		r, err := app.showChoiceNotification("KeePassSync: Upload failed", "Conflict with remote file.\n[1] Overwrite remote file\n[2] Download remote and sync manually", map[string]string{"o": "Overwrite", "d": "Download", "a": "Abort"})
 		if err != nil {
-			app.LogError("Failed to show choice notification", err)
-			return
+			op.LogError("Failed to show choice notification", err)
+			return exerr.Wrap(err, "").Build()
 		}
 
 		if r == "o" {
 
-			app.LogInfo("Uploading database to remote (unchecked)")
+			op.LogInfo("Uploading database to remote (unchecked)")
 
-			etag, lm, sha, sz, err := app.uploadDatabase(nil) // unchecked upload
+			etag, lm, sha, sz, err := app.uploadDatabase(op, nil) // unchecked upload
+			if errors.Is(err, InvalidDatabaseError) {
+				return err // already reported by rejectInvalidDatabase
+			}
 			if err != nil {
-				app.LogError("Failed to upload remote database", err)
+				op.LogError("Failed to upload remote database", err)
 				app.showErrorNotification("KeePassSync: Error", "Failed to upload remote database")
-				return
+				return exerr.Wrap(err, "").Build()
 			}
 
-			app.LogInfo(fmt.Sprintf("Uploaded database to remote"))
-			app.LogDebug(fmt.Sprintf("Checksum     := %s", sha))
-			app.LogDebug(fmt.Sprintf("ETag         := %s", etag))
-			app.LogDebug(fmt.Sprintf("Size         := %s (%d)", langext.FormatBytes(sz), sz))
-			app.LogDebug(fmt.Sprintf("LastModified := %s", lm.Format(time.RFC3339)))
+			op.LogInfoWith("Uploaded database to remote", FD("checksum", sha), FD("etag", etag), FD("size", sz), FD("last_modified", lm))
 
 			err = app.saveState(etag, lm, sha, sz)
 			if err != nil {
-				app.LogError("Failed to save state", err)
+				op.LogError("Failed to save state", err)
 				app.showErrorNotification("KeePassSync: Error", "Failed to save state")
-				return
+				return exerr.Wrap(err, "").Build()
 			}
 
 			app.showSuccessNotification("KeePassSync", "Uploaded database successfully (overwrite remote)")
 
 			app.LogLine()
 
-			return
+			return nil
 
 		} else if r == "d" {
 
-			app.LogInfo(fmt.Sprintf("Re-Downloading remote database to %s", app.dbFile))
+			op.LogInfo(fmt.Sprintf("Re-Downloading remote database to %s", app.dbFile))
 
-			etag, lm, sha, sz, err := app.downloadDatabase()
+			etag, lm, sha, sz, err := app.downloadDatabase(op, nil)
 			if err != nil {
-				app.LogError("Failed to download remote database", err)
-				return
+				op.LogError("Failed to download remote database", err)
+				return exerr.Wrap(err, "").Build()
 			}
 
-			app.LogInfo(fmt.Sprintf("Downloaded remote database to %s", app.dbFile))
-			app.LogInfo(fmt.Sprintf("Checksum     := %s", sha))
-			app.LogInfo(fmt.Sprintf("ETag         := %s", etag))
-			app.LogInfo(fmt.Sprintf("Size         := %s (%d)", langext.FormatBytes(sz), sz))
-			app.LogInfo(fmt.Sprintf("LastModified := %s", lm.Format(time.RFC3339)))
+			op.LogInfoWith(fmt.Sprintf("Downloaded remote database to %s", app.dbFile), F("checksum", sha), F("etag", etag), F("size", sz), F("last_modified", lm))
 
 			err = app.saveState(etag, lm, sha, sz)
 			if err != nil {
-				app.LogError("Failed to save state", err)
-				return
+				op.LogError("Failed to save state", err)
+				return exerr.Wrap(err, "").Build()
 			}
 
 			app.showSuccessNotification("KeePassSync", "Re-Downloaded database successfully")
 
 			app.LogLine()
 
+			return nil
+
 		} else if r == "a" {
 
 			app.sigManualStopChan <- true
-			return
+			return ETagConflictError
 
 		} else {
-			app.LogError("Unknown choice in notification: '"+r+"'", nil)
+			op.LogError("Unknown choice in notification: '"+r+"'", nil)
 			app.showErrorNotification("KeePassSync: Error", "Unknown choice in notification: '"+r+"'")
-			return
+			return ETagConflictError
 		}
 
+	} else if errors.Is(err, InvalidDatabaseError) {
+		return err // already reported by rejectInvalidDatabase
+	} else if errors.Is(err, ETagConflictError) {
+		op.LogError("Failed to upload remote database - remote file was modified (ETag conflict)", nil)
+		app.showErrorNotification("KeePassSync: Error", "Failed to upload remote database (conflict with remote file)")
+		return err
 	} else if err != nil {
-		app.LogError("Failed to upload remote database", err)
+		op.LogError("Failed to upload remote database", err)
 		app.showErrorNotification("KeePassSync: Error", "Failed to upload remote database")
-		return
+		return exerr.Wrap(err, "").Build()
 	}
 
-	app.LogInfo(fmt.Sprintf("Uploaded database to remote"))
-	app.LogDebug(fmt.Sprintf("Checksum     := %s", sha))
-	app.LogDebug(fmt.Sprintf("ETag         := %s", etag))
-	app.LogDebug(fmt.Sprintf("Size         := %s (%d)", langext.FormatBytes(sz), sz))
-	app.LogDebug(fmt.Sprintf("LastModified := %s", lm.Format(time.RFC3339)))
+	op.LogInfoWith("Uploaded database to remote", FD("checksum", sha), FD("etag", etag), FD("size", sz), FD("last_modified", lm))
 
 	err = app.saveState(etag, lm, sha, sz)
 	if err != nil {
-		app.LogError("Failed to save state", err)
+		op.LogError("Failed to save state", err)
 		app.showErrorNotification("KeePassSync: Error", "Failed to save state")
-		return
+		return exerr.Wrap(err, "").Build()
 	}
 
 	app.showSuccessNotification("KeePassSync", "Uploaded database successfully")
 
 	app.LogLine()
+
+	return nil
 }
 
 func (app *Application) runFinalSync() {
@@ -373,34 +368,43 @@ func (app *Application) runFinalSync() {
 	defer app.uploadActive.Set(false)
 	app.masterLock.Unlock()
 
+	op := app.beginOperation("final-sync")
+	defer op.End()
+
 	fin1 := app.setTrayState("Uploading database", assets.IconUpload)
 	defer fin1()
 
-	app.LogInfo("Starting final sync...")
+	op.LogInfo("Starting final sync...")
 
-	remoteETag, _, err := app.getRemoteState()
-	if err != nil {
-		app.LogError("Failed to get remote ETag", err)
+	// keepassxc may have saved while shutting down - make sure that write is complete
+	if stable, invalidKDBX, reason := app.waitForStableFile(op); !stable {
+		if invalidKDBX {
+			op.LogWarn("Database file is not valid (" + reason + ")")
+			// continue, uploadDatabase rejects (and reports) the file
+		} else {
+			app.postponeUnstableUpload(op, reason, false)
+		}
 	}
 
 	state := app.readState()
 	localCS, err := app.calcLocalChecksum()
 	if err != nil {
-		app.LogError("Failed to calculate local database checksum", err)
+		op.LogError("Failed to calculate local database checksum", err)
 		app.showErrorNotification("KeePassSync: Error", "Failed to calculate local database checksum")
 		return
 	}
 
-	if state != nil && localCS == state.Checksum && remoteETag == state.ETag {
-		app.LogInfo("Local database still matches remote (via checksum+etag) - no need to upload")
-		app.LogInfo(fmt.Sprintf("Checksum (remote/cached) := %s", state.Checksum))
-		app.LogInfo(fmt.Sprintf("Checksum (local)         := %s", localCS))
-		app.LogDebug(fmt.Sprintf("ETag (local)            := %s", state.ETag))
-		app.LogDebug(fmt.Sprintf("ETag (remote)           := %s", remoteETag))
+	if state != nil && localCS == state.Checksum {
+		// no need to ask the server - the upload would be conditional on state.ETag anyway
+		op.LogInfoWith("Local database still matches remote (via checksum) - no need to upload", F("checksum_remote", state.Checksum), F("checksum_local", localCS), FD("etag_cached", state.ETag))
 		return
 	}
 
-	app.doDBUpload(state, fin1, false)
+	if !app.checkUploadSizeAnomaly(op, state) {
+		return
+	}
+
+	app.doDBUpload(op, state, fin1, false)
 }
 
 func (app *Application) runExplicitSync(force bool) {
@@ -411,36 +415,360 @@ func (app *Application) runExplicitSync(force bool) {
 	defer app.uploadActive.Set(false)
 	app.masterLock.Unlock()
 
+	op := app.beginOperation("explicit-sync")
+	defer op.End()
+
 	state := app.readState()
 
 	if !force {
 
-		remoteETag, _, err := app.getRemoteState()
+		remoteETag, _, err := app.getRemoteState(op)
 		if err != nil {
-			app.LogError("Failed to get remote ETag", err)
+			op.LogError("Failed to get remote ETag", err)
 			app.showErrorNotification("KeePassSync: Error", "Failed to get status from remote")
 			return
 		}
 
 		localCS, err := app.calcLocalChecksum()
 		if err != nil {
-			app.LogError("Failed to calculate local database checksum", err)
+			op.LogError("Failed to calculate local database checksum", err)
 			app.showErrorNotification("KeePassSync: Error", "Failed to calculate local database checksum")
 			return
 		}
 
 		if state != nil && localCS == state.Checksum {
-			app.LogInfo("Local database still matches remote (via checksum+etag) - no need to upload")
-			app.LogInfo(fmt.Sprintf("Checksum (remote/cached) := %s", state.Checksum))
-			app.LogInfo(fmt.Sprintf("Checksum (local)         := %s", localCS))
-			app.LogDebug(fmt.Sprintf("ETag (local)            := %s", state.ETag))
-			app.LogDebug(fmt.Sprintf("ETag (remote)           := %s", remoteETag))
+			op.LogInfoWith("Local database still matches remote (via checksum+etag) - no need to upload", F("checksum_remote", state.Checksum), F("checksum_local", localCS), FD("etag_local", state.ETag), FD("etag_remote", remoteETag))
 
 			app.showSuccessNotification("KeePassSync", "No sync necessary - file is up-to-date with remote")
 			return
 		}
 
+		if !app.checkUploadSizeAnomaly(op, state) {
+			return
+		}
+
+	}
+
+	app.doDBUpload(op, state, func() {}, true)
+}
+
+// runFastStartCheck is the deferred initial download of a fast start (keepassxc is already running on the cached database).
+// A newer remote database replaces the local file (keepassxc reloads it), if the local file was modified as well
+// the upload goes through the normal conflict handling.
+func (app *Application) runFastStartCheck() {
+	app.masterLock.Lock()
+	app.uploadDCI.CancelPendingRequests()
+	app.uploadActive.Wait(false)
+	app.uploadActive.Set(true)
+	defer app.uploadActive.Set(false)
+
+	app.fastStartPending = false
+	app.masterLock.Unlock()
+
+	op := app.beginOperation("fast-start-check")
+	defer op.End()
+
+	fin := app.setTrayState("Checking remote database", assets.IconDownload)
+	defer fin()
+
+	state := app.readState()
+	if state == nil {
+		op.LogError("Fast start check: no state available", nil)
+		return
+	}
+
+	op.LogInfo(fmt.Sprintf("Fast start - checking remote database (if not matching ETag %s)", state.ETag))
+
+	etag, lm, sha, sz, err := app.downloadToPartial(op, langext.Ptr(state.ETag))
+	if errors.Is(err, NotModifiedError) {
+		op.LogInfo("Fast start - cached database is up-to-date with remote")
+		app.requestUploadIfModified(op, state)
+		app.LogLine()
+		return
+	}
+	if errors.Is(err, InvalidDatabaseError) {
+		app.requestUploadIfModified(op, state) // already reported by rejectInvalidDatabase
+		return
+	}
+	if err != nil {
+		op.LogError("Fast start - failed to check remote database", err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to check remote database.\nYou are working on the cached copy, changes are uploaded once the remote is reachable.")
+		app.requestUploadIfModified(op, state)
+		return
+	}
+
+	op.LogInfo(fmt.Sprintf("Fast start - remote database has changed (ETag %s -> %s)", state.ETag, etag))
+
+	localCS, err := app.calcLocalChecksum()
+	if err != nil {
+		op.LogError("Failed to calculate local database checksum", err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to calculate local database checksum")
+		return
+	}
+
+	if localCS != state.Checksum {
+		// both sides changed - the conditional upload fails with a conflict and the user decides
+		op.LogWarn("Fast start - local database was modified as well - resolving conflict")
+		app.discardPartialDownload()
+
+		if !app.checkUploadSizeAnomaly(op, state) {
+			return
+		}
+
+		app.doDBUpload(op, state, fin, true)
+		return
+	}
+
+	err = app.replaceLocalDatabase(sha)
+	if err != nil {
+		op.LogError("Failed to replace local database", err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to replace local database with newer remote version")
+		return
+	}
+
+	op.LogInfoWith(fmt.Sprintf("Replaced cached database with remote version %s", app.dbFile), F("checksum", sha), F("etag", etag), F("size", sz), F("last_modified", lm))
+
+	err = app.saveState(etag, lm, sha, sz)
+	if err != nil {
+		op.LogError("Failed to save state", err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to save state")
+		return
+	}
+
+	app.showSuccessNotification("KeePassSync", "Remote database was newer - reloaded it")
+
+	app.LogLine()
+}
+
+// requestUploadIfModified requests an upload if the local database differs from state
+// (the pending upload requests were cancelled, changes saved in the meantime would be lost otherwise)
+func (app *Application) requestUploadIfModified(op *syncOp, state *State) {
+	localCS, err := app.calcLocalChecksum()
+	if err != nil {
+		op.LogError("Failed to calculate local database checksum", err)
+		return
+	}
+
+	if localCS != state.Checksum {
+		op.LogInfo("Local database was modified in the meantime - requesting upload")
+		app.uploadDCI.Request()
+	}
+}
+
+// checkUploadSizeAnomaly asks the user before uploading a database that is suspiciously small
+// (shrunk by more than config.ShrinkThreshold percent or smaller than config.MinSize).
+// Returns true if the upload should continue.
+func (app *Application) checkUploadSizeAnomaly(op *syncOp, state *State) bool {
+	fi, err := os.Stat(app.dbFile)
+	if err != nil {
+		op.LogError("Failed to stat local database", err)
+		return true // the upload itself will fail and report this
+	}
+
+	localSize := fi.Size()
+
+	reason := ""
+	if app.cfg().MinSize > 0 && localSize < app.cfg().MinSize {
+		reason = fmt.Sprintf("The local database is only %s (minimum: %s).", langext.FormatBytes(localSize), langext.FormatBytes(app.cfg().MinSize))
+	} else if app.cfg().ShrinkThreshold > 0 && state != nil && state.Size > 0 && localSize < state.Size*int64(100-app.cfg().ShrinkThreshold)/100 {
+		reason = fmt.Sprintf("The local database shrunk from %s to %s (-%d%%).", langext.FormatBytes(state.Size), langext.FormatBytes(localSize), 100-localSize*100/state.Size)
+	}
+
+	if reason == "" {
+		return true
+	}
+
+	op.LogWarn("Upload paused - size anomaly detected: " + reason)
+
+	fin := app.setTrayState("Uploading database (waiting for confirmation)", assets.IconUploadConflict)
+	defer fin()
+
+	r, err := app.showChoiceNotification("KeePassSync: Suspicious upload", reason+"\nUpload anyway?", map[string]string{"u": "Upload", "s": "Snapshot remote & Upload", "d": "Discard local changes", "k": "Skip"})
+	if err != nil {
+		op.LogError("Failed to show choice notification", err)
+		r = ""
+	}
+
+	if r == "u" {
+
+		op.LogInfo("Size-anomaly decision: [Upload] - uploading database")
+		return true
+
+	} else if r == "s" {
+
+		op.LogInfo("Size-anomaly decision: [Snapshot remote & Upload] - saving snapshot of the remote database and uploading database")
+
+		// the remote version is the one that gets overwritten (the local file is uploaded anyway)
+		_, err := app.snapshotRemoteDatabase(op, "before-shrink")
+		if err != nil {
+			op.LogError("Failed to create snapshot - aborting upload", err)
+			app.showErrorNotification("KeePassSync: Error", "Failed to create snapshot - upload aborted")
+			app.markUploadSkipped()
+			return false
+		}
+
+		return true
+
+	} else if r == "d" {
+
+		op.LogInfo("Size-anomaly decision: [Discard] - replacing the local database with the last synced (remote) version")
+		app.discardLocalChanges(op)
+		return false
+
+	} else if r == "k" {
+
+		op.LogInfo("Size-anomaly decision: [Skip] - upload skipped, local changes are NOT synced (asking again on the next change or start)")
+		app.markUploadSkipped()
+		return false
+
+	} else {
+
+		op.LogInfo("Size-anomaly decision: <none> (notification dismissed) - upload skipped, local changes are NOT synced (asking again on the next change or start)")
+		app.markUploadSkipped()
+		return false
+
+	}
+}
+
+// discardLocalChanges replaces the local database with the remote version (the local file is kept as snapshot)
+func (app *Application) discardLocalChanges(op *syncOp) {
+	fp, err := app.snapshotDatabase("discarded")
+	if err != nil {
+		op.LogError("Failed to create snapshot - local changes are not discarded", err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to create snapshot - local changes are not discarded")
+		app.markUploadSkipped()
+		return
+	}
+
+	etag, lm, sha, sz, err := app.downloadDatabase(op, nil)
+	if errors.Is(err, InvalidDatabaseError) {
+		app.markUploadSkipped() // already reported by rejectInvalidDatabase
+		return
+	}
+	if err != nil {
+		op.LogError("Failed to download remote database", err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to download remote database - local changes are not discarded")
+		app.markUploadSkipped()
+		return
+	}
+
+	op.LogInfoWith(fmt.Sprintf("Restored remote database to %s", app.dbFile), F("checksum", sha), F("etag", etag), F("size", sz), F("last_modified", lm))
+
+	err = app.saveState(etag, lm, sha, sz)
+	if err != nil {
+		op.LogError("Failed to save state", err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to save state")
+		return
+	}
+
+	app.showSuccessNotification("KeePassSync", fmt.Sprintf("Discarded local changes (copy saved to %s)", fp))
+
+	app.LogLine()
+}
+
+// markUploadSkipped remembers that the local changes were not uploaded, so initSync does not overwrite them on the next start
+// (the marker is removed by saveState)
+func (app *Application) markUploadSkipped() {
+	if app.skippedFile == "" {
+		return
+	}
+	if err := os.WriteFile(app.skippedFile, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		app.LogError("Failed to write upload-skipped marker", err)
+	}
+}
+
+// PullResult is the outcome of runPull
+type PullResult string //@enum:type
+
+const (
+	PullResultDownloaded    PullResult = "DOWNLOADED"
+	PullResultUpToDate      PullResult = "UP_TO_DATE"
+	PullResultUploadActive  PullResult = "SKIPPED_UPLOAD_ACTIVE"
+	PullResultLocalModified PullResult = "SKIPPED_LOCAL_MODIFIED"
+	PullResultPaused        PullResult = "SKIPPED_PAUSED"
+)
+
+// runPull downloads remote changes into the work dir of the running instance (resident mode, `kpsync ctl pull`).
+// Nothing is downloaded if the local database has un-synced changes or an upload is pending.
+func (app *Application) runPull() (PullResult, error) {
+	app.masterLock.Lock()
+	if app.syncPaused.Get() {
+		app.masterLock.Unlock()
+		app.LogDebug("Skipping pull - sync is paused")
+		return PullResultPaused, nil
 	}
+	if app.uploadActive.Get() || app.uploadWaiting.Get() || app.uploadDCI.HasPendingRequests() {
+		app.masterLock.Unlock()
+		app.LogDebug("Skipping pull - upload in progress")
+		return PullResultUploadActive, nil
+	}
+	app.uploadActive.Set(true)
+	defer app.uploadActive.Set(false)
+	app.masterLock.Unlock()
 
-	app.doDBUpload(state, func() {}, true)
+	op := app.beginOperation("pull")
+	defer op.End()
+
+	state := app.readState()
+	if state == nil {
+		return "", exerr.New(exerr.TypeInternal, "No state available").Build()
+	}
+
+	localCS, err := app.calcLocalChecksum()
+	if err != nil {
+		op.LogError("Failed to calculate local database checksum", err)
+		return "", exerr.Wrap(err, "").Build()
+	}
+
+	if localCS != state.Checksum {
+		op.LogWarn("Skipping pull - local database has un-synced changes")
+		return PullResultLocalModified, nil
+	}
+
+	etag, lm, sha, sz, err := app.downloadDatabase(op, &state.ETag)
+	if errors.Is(err, NotModifiedError) {
+		op.LogDebug("Pull: remote database is unchanged")
+		return PullResultUpToDate, nil
+	}
+	if err != nil {
+		op.LogError("Failed to pull remote database", err)
+		return "", exerr.Wrap(err, "").Build()
+	}
+
+	op.LogInfoWith(fmt.Sprintf("Pulled changed remote database to %s", app.dbFile), F("checksum", sha), F("etag", etag), F("size", sz), F("last_modified", lm))
+
+	err = app.saveState(etag, lm, sha, sz)
+	if err != nil {
+		op.LogError("Failed to save state", err)
+		return "", exerr.Wrap(err, "").Build()
+	}
+
+	app.LogLine()
+
+	return PullResultDownloaded, nil
+}
+
+// runResidentPullLoop periodically pulls remote changes while keepassxc is not running (resident mode)
+func (app *Application) runResidentPullLoop() {
+	app.LogDebug(fmt.Sprintf("Starting resident pull loop (interval: %s)", app.residentPullInterval()))
+
+	for {
+		select {
+		case <-app.sigResidentStopChan:
+			app.LogDebug("Stopping resident pull loop (received signal)")
+			return
+		case <-time.After(app.residentPullInterval()): // re-evaluated every time, the interval can change on config reload
+			if app.keepassRunning.Get() {
+				continue // keepassxc has the database open, changes are uploaded by the sync loop
+			}
+			_, _ = app.runPull()
+		}
+	}
+}
+
+func (app *Application) residentPullInterval() time.Duration {
+	if app.cfg().ResidentPullInterval <= 0 {
+		return 5 * time.Minute
+	}
+	return timeext.FromMilliseconds(app.cfg().ResidentPullInterval)
 }
@@ -24,6 +24,17 @@ func (app *Application) initTray() {
 		miShowLogFifo := systray.AddMenuItem("Show Log (fifo)", "")
 		miShowLogFile := systray.AddMenuItem("Show Log (file)", "")
 
+		var openKeepassCh chan struct{} = nil // nil channel - never fires if the item does not exist
+		if app.cfg().Resident && !app.cfg().NoLaunch {
+			app.trayItemOpenKeepass = systray.AddMenuItem("Open KeePassXC", "")
+			app.trayItemOpenKeepass.Disable()
+			openKeepassCh = app.trayItemOpenKeepass.ClickedCh
+		}
+
+		app.trayItemRestartHint = systray.AddMenuItem("Restart required", "")
+		app.trayItemRestartHint.Disable()
+		app.trayItemRestartHint.Hide()
+
 		systray.AddMenuItem("", "").Disable()
 
 		app.trayItemChecksum = systray.AddMenuItem("Checksum: {...}", "")
@@ -60,10 +71,14 @@ func (app *Application) initTray() {
 					app.LogDebug("SysTray: [Show Log File] clicked")
 					app.LogLine()
 					go func() { app.openLogFile() }()
+				case <-openKeepassCh:
+					app.LogDebug("SysTray: [Open KeePassXC] clicked")
+					app.LogLine()
+					go func() { app.launchKeepass() }()
 				case <-miQuit.ClickedCh:
 					app.LogDebug("SysTray: [Quit] clicked")
 					app.LogLine()
-					app.sigManualStopChan <- true
+					app.sigQuitChan <- true
 				case <-sigBGStop:
 					app.LogDebug("SysTray: Click-Listener goroutine stopped")
 					app.LogLine()
@@ -148,3 +163,44 @@ func (app *Application) setTrayTooltip(txt string) {
 	app.currSysTrayTooltip = "KPSync | " + txt
 	systray.SetTooltip(app.currSysTrayTooltip)
 }
+
+func (app *Application) setTrayOpenKeepassEnabled(enabled bool) {
+	if !app.trayReady.Get() {
+		return
+	}
+
+	app.masterLock.Lock()
+	defer app.masterLock.Unlock()
+
+	if app.trayItemOpenKeepass == nil {
+		return
+	}
+
+	if enabled {
+		app.trayItemOpenKeepass.Enable()
+	} else {
+		app.trayItemOpenKeepass.Disable()
+	}
+}
+
+// setTrayRestartHint shows a (disabled) menu entry that kpsync must be restarted to apply a config change ("" hides it)
+func (app *Application) setTrayRestartHint(txt string) {
+	if !app.trayReady.Get() {
+		return
+	}
+
+	app.masterLock.Lock()
+	defer app.masterLock.Unlock()
+
+	if app.trayItemRestartHint == nil {
+		return
+	}
+
+	if txt == "" {
+		app.trayItemRestartHint.Hide()
+		return
+	}
+
+	app.trayItemRestartHint.SetTitle(txt)
+	app.trayItemRestartHint.Show()
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+)
+
+type UnlockConfig struct {
+	KeyFile         string            `json:"key_file"`         // passed to keepassxc as --keyfile
+	PasswordCommand string            `json:"password_command"` // shell command that prints the master password to stdout
+	SecretService   map[string]string `json:"secret_service"`   // attributes to look up the master password via `secret-tool lookup`
+	Fallback        bool              `json:"fallback"`         // also unlock the local fallback database (only if it uses the same key file / password)
+}
+
+// applyUnlock adds the --keyfile / --pw-stdin arguments to a keepassxc launcher command.
+// Returns the master password that must be written to the stdin of cmd (or nil).
+// The password is never logged, the caller should wipe it (wipeSecret) after use.
+// Nothing is added if the launcher is not keepassxc (other programs don't know these options)
+// or for the local fallback database (unless unlock.fallback is set).
+func (app *Application) applyUnlock(cmd *exec.Cmd, dbPath string, fallback bool) []byte {
+	uc := app.cfg().Unlock
+	if uc == nil {
+		return nil
+	}
+
+	if !app.launcherIsKeepassXC() {
+		app.LogWarn("The configured launcher is not keepassxc - ignoring the unlock config")
+		return nil
+	}
+
+	if fallback && !uc.Fallback {
+		app.LogDebug("Not unlocking the local fallback database (unlock.fallback is not set)")
+		return nil
+	}
+
+	extraArgs := make([]string, 0, 3)
+
+	if uc.KeyFile != "" {
+		kf := expandHome(uc.KeyFile)
+		if !fileExists(kf) {
+			app.LogError(fmt.Sprintf("Configured key file '%s' not found - not passing it to keepassxc", kf), nil)
+		} else {
+			extraArgs = append(extraArgs, "--keyfile", kf)
+		}
+	}
+
+	secret, source, err := app.readMasterPassword(uc)
+	if err != nil {
+		app.LogError("Failed to read master password from "+source, err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to read master password from "+source+" - you will have to enter it manually.")
+	} else if secret != nil {
+		app.LogInfo("Passing master password to keepassxc via --pw-stdin (from " + source + ")")
+		extraArgs = append(extraArgs, "--pw-stdin")
+	}
+
+	if len(extraArgs) == 0 {
+		return nil
+	}
+
+	// options must come before the database path
+	idx := slices.Index(cmd.Args, dbPath)
+	if idx < 1 {
+		idx = len(cmd.Args)
+	}
+	cmd.Args = slices.Insert(cmd.Args, idx, extraArgs...)
+
+	return secret
+}
+
+func (app *Application) readMasterPassword(uc *UnlockConfig) ([]byte, string, error) {
+	if uc.PasswordCommand != "" {
+		secret, err := runSecretCommand(exec.Command("sh", "-c", uc.PasswordCommand))
+		return secret, "password_command", err
+	}
+
+	if len(uc.SecretService) > 0 {
+		args := []string{"lookup"}
+		keys := make([]string, 0, len(uc.SecretService))
+		for k := range uc.SecretService {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			args = append(args, k, uc.SecretService[k])
+		}
+
+		secret, err := runSecretCommand(exec.Command("secret-tool", args...))
+		return secret, "secret_service", err
+	}
+
+	return nil, "", nil
+}
+
+// runSecretCommand returns the stdout of cmd (without trailing newline), stdout is never logged
+func runSecretCommand(cmd *exec.Cmd) ([]byte, error) {
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		wipeSecret(stdout.Bytes())
+		return nil, exerr.Wrap(err, "secret command failed").Str("stderr", strings.TrimSpace(stderr.String())).Build()
+	}
+
+	secret := stdout.Bytes()
+	for len(secret) > 0 && (secret[len(secret)-1] == '\n' || secret[len(secret)-1] == '\r') {
+		secret = secret[:len(secret)-1]
+	}
+
+	if len(secret) == 0 {
+		return nil, exerr.New(exerr.TypeInternal, "secret command returned an empty password").Build()
+	}
+
+	return secret, nil
+}
+
+// writeSecret writes the secret (+ newline) to w and closes it
+func writeSecret(w io.WriteCloser, secret []byte) error {
+	defer func() { _ = w.Close() }()
+
+	if _, err := w.Write(secret); err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+	if _, err := w.Write([]byte{'\n'}); err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+
+	return nil
+}
+
+func wipeSecret(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
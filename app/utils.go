@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -69,6 +71,12 @@ func (app *Application) saveState(eTag string, lastModified time.Time, checksum
 		return exerr.Wrap(err, "Failed to write state file").Build()
 	}
 
+	if app.skippedFile != "" {
+		if err := os.Remove(app.skippedFile); err != nil && !os.IsNotExist(err) {
+			return exerr.Wrap(err, "Failed to delete upload-skipped marker").Build()
+		}
+	}
+
 	if app.trayItemChecksum != nil {
 		app.trayItemChecksum.SetTitle(fmt.Sprintf("Checksum: %s", langext.StrLimit(checksum, 16, "")))
 	}
@@ -82,6 +90,52 @@ func (app *Application) saveState(eTag string, lastModified time.Time, checksum
 	return nil
 }
 
+type PartialState struct {
+	ETag         string    `json:"etag"`
+	ETagHeader   string    `json:"etag_header"` // the ETag header as sent by the server (incl. quotes and W/ prefix), for If-Range
+	Size         int64     `json:"size"`
+	Checksum     string    `json:"checksum"` // SHA-256 advertised by the server, "" if it sent none (then the file is not verified)
+	LastModified time.Time `json:"lastModified"`
+}
+
+func (app *Application) readPartialState() *PartialState {
+	bin, err := os.ReadFile(app.partialStateFile)
+	if err != nil {
+		return nil
+	}
+
+	var state PartialState
+	err = json.Unmarshal(bin, &state)
+	if err != nil {
+		return nil
+	}
+
+	return &state
+}
+
+func (app *Application) savePartialState(state PartialState) error {
+	bin, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return exerr.Wrap(err, "Failed to marshal partial-download state").Build()
+	}
+
+	err = os.WriteFile(app.partialStateFile, bin, 0644)
+	if err != nil {
+		return exerr.Wrap(err, "Failed to write partial-download state file").Build()
+	}
+
+	return nil
+}
+
+func (app *Application) discardPartialDownload() {
+	if err := os.Remove(app.partialFile); err != nil && !os.IsNotExist(err) {
+		app.LogError("Failed to delete partial download file", err)
+	}
+	if err := os.Remove(app.partialStateFile); err != nil && !os.IsNotExist(err) {
+		app.LogError("Failed to delete partial-download state file", err)
+	}
+}
+
 func (app *Application) calcLocalChecksum() (string, error) {
 	bin, err := os.ReadFile(app.dbFile)
 	if err != nil {
@@ -91,27 +145,72 @@ func (app *Application) calcLocalChecksum() (string, error) {
 	return cryptext.BytesSha256(bin), nil
 }
 
-func (app *Application) isKeepassRunning() bool {
+// findKeepassProcesses returns all running processes that match the configured launcher (see launcherProcessNames)
+func (app *Application) findKeepassProcesses() []*process.Process {
 	proc, err := process.Processes()
 	if err != nil {
 		app.LogError("failed to query existing keepass process", err)
-		return false
+		return nil
 	}
 
+	names := app.launcherProcessNames()
+
+	res := make([]*process.Process, 0)
+
 	for _, p := range proc {
 		name, err := p.Name()
 		if err != nil {
 			continue
 		}
 
-		if strings.ToLower(name) == "keepass" || strings.ToLower(name) == "keepassxc" {
-			return true
+		if slices.Contains(names, strings.ToLower(name)) {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+// processUsesFile returns true if p has fp opened (or got it passed as an argument)
+func processUsesFile(p *process.Process, fp string) bool {
+	target := resolvePath(fp)
+
+	if args, err := p.CmdlineSlice(); err == nil && len(args) > 1 {
+		cwd, _ := p.Cwd()
+		for _, arg := range args[1:] {
+			if !filepath.IsAbs(arg) {
+				if cwd == "" {
+					continue
+				}
+				arg = filepath.Join(cwd, arg)
+			}
+			if resolvePath(arg) == target {
+				return true
+			}
+		}
+	}
+
+	if files, err := p.OpenFiles(); err == nil {
+		for _, f := range files {
+			if resolvePath(f.Path) == target {
+				return true
+			}
 		}
 	}
 
 	return false
 }
 
+func resolvePath(fp string) string {
+	if v, err := filepath.Abs(fp); err == nil {
+		fp = v
+	}
+	if v, err := filepath.EvalSymlinks(fp); err == nil {
+		fp = v
+	}
+	return fp
+}
+
 func commandExists(cmd string) bool {
 	_, err := exec.LookPath(cmd)
 	return err == nil
@@ -1,74 +1,274 @@
 package app
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
 	"time"
 
 	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+	"git.blackforestbytes.com/BlackForestBytes/goext/timeext"
 	"github.com/fsnotify/fsnotify"
 	"mikescher.com/kpsync/assets"
 )
 
+type WatchMode string //@enum:type
+
+const (
+	WatchModeAuto    WatchMode = "auto"
+	WatchModeInotify WatchMode = "inotify"
+	WatchModePoll    WatchMode = "poll"
+)
+
+const watcherHealthCheckInterval = 30 * time.Second
+
+// filesystems where inotify does not report (remote) changes, see statfs(2)
+var inotifyUnsupportedFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x65735546: "fuse",
+	0x517B:     "smb",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x01021997: "9p",
+	0x00C36400: "ceph",
+}
+
 func (app *Application) runSyncWatcher() error {
+	mode := WatchMode(app.cfg().WatchMode)
+	if mode == "" {
+		mode = WatchModeAuto
+	}
+
+	if mode == WatchModeAuto {
+		if fs, unsupported := inotifyUnsupported(app.cfg().WorkDir); unsupported {
+			app.LogInfo(fmt.Sprintf("Work directory is on a '%s' filesystem (no reliable inotify support) - using polling file-watcher", fs))
+			mode = WatchModePoll
+		}
+	}
+
+	if mode == WatchModePoll {
+		return app.runPollingWatcher()
+	} else if mode != WatchModeInotify && mode != WatchModeAuto {
+		return exerr.New(exerr.TypeInternal, "Unknown watch mode: "+string(mode)).Build()
+	}
+
+	for {
+		stopped, err := app.runInotifyWatcher()
+		if stopped {
+			return nil
+		}
+
+		if errors.Is(err, errInotifyUnavailable) && mode == WatchModeAuto {
+			app.LogError("inotify is not available - falling back to polling file-watcher", err)
+			return app.runPollingWatcher()
+		}
+
+		if err != nil {
+			app.LogError("File-watcher stopped unexpectedly - re-arming", err)
+		} else {
+			app.LogWarn("File-watcher lost its watch - re-arming")
+		}
+
+		select {
+		case <-app.sigSyncLoopStopChan:
+			app.LogInfo("Stopping sync loop (received signal)")
+			return nil
+		case <-time.After(1 * time.Second):
+		}
+
+		if _, err := os.Stat(app.cfg().WorkDir); errors.Is(err, os.ErrNotExist) {
+			app.LogWarn(fmt.Sprintf("Work directory '%s' was removed - re-creating", app.cfg().WorkDir))
+			if err := os.MkdirAll(app.cfg().WorkDir, os.ModePerm); err != nil {
+				app.LogError("Failed to re-create work directory", err)
+				continue
+			}
+		}
+
+		// we may have missed events while the watcher was down
+		if fileExists(app.dbFile) {
+			app.onDBFileChanged("re-armed watcher")
+		}
+	}
+}
+
+var errInotifyUnavailable = errors.New("inotify unavailable")
+
+// runInotifyWatcher watches the work dir until a stop signal is received (returns true)
+// or the watch is lost (returns false, e.g. the work dir was removed or the watcher died)
+func (app *Application) runInotifyWatcher() (bool, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		return exerr.Wrap(err, "failed to init file-watcher").Build()
+		return false, errors.Join(errInotifyUnavailable, err)
 	}
 	defer func() { _ = watcher.Close() }()
 
-	err = watcher.Add(app.config.WorkDir)
+	workDir := filepath.Clean(app.cfg().WorkDir) // fsnotify cleans the path (WatchList and event names)
+
+	err = watcher.Add(workDir)
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.ENOSYS) {
+		return false, errors.Join(errInotifyUnavailable, err)
+	}
 	if err != nil {
-		return exerr.Wrap(err, "").Build()
+		return false, exerr.Wrap(err, "").Build()
 	}
 
+	healthTicker := time.NewTicker(watcherHealthCheckInterval)
+	defer healthTicker.Stop()
+
 	for {
 		select {
 		case <-app.sigSyncLoopStopChan:
 			app.LogInfo("Stopping sync loop (received signal)")
-			return nil
+			return true, nil
 
-		case event := <-watcher.Events:
-			if event.Name != app.dbFile {
-				continue // no log!! otherwise we end in an endless log-loop
+		case <-healthTicker.C:
+			if !slices.Contains(watcher.WatchList(), workDir) {
+				return false, nil
+			}
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return false, exerr.New(exerr.TypeInternal, "file-watcher event channel closed").Build()
 			}
-			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+
+			if event.Name == workDir && (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) {
+				return false, nil
+			}
+
+			if event.Name != app.dbFile {
 				continue // no log!! otherwise we end in an endless log-loop
 			}
 
 			app.LogDebug(fmt.Sprintf("Received inotify event: [%s] %s", event.Op.String(), event.Name))
 
-			localCS, err := app.calcLocalChecksum()
-			if err != nil {
-				app.LogError("Failed to calculate local database checksum", err)
-				app.showErrorNotification("KeePassSync: Error", "Failed to calculate checksum")
-				continue
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Chmod) {
+				app.onDBFileChanged("inotify")
+			} else if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				if fileExists(app.dbFile) {
+					app.onDBFileChanged("inotify") // replaced (e.g. rename-over)
+				} else {
+					app.LogWarn("Database file was moved away or deleted - waiting for it to re-appear")
+				}
 			}
 
-			ignoreFN := func() bool {
-				app.masterLock.Lock()
-				defer app.masterLock.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return false, exerr.New(exerr.TypeInternal, "file-watcher error channel closed").Build()
+			}
 
-				for _, ign := range app.fileWatcherIgnore {
-					if ign.V2 == localCS && time.Since(ign.V1) < 10*time.Second {
-						return true
-					}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				app.LogWarn("Filewatcher event queue overflowed - checking database for changes")
+				if fileExists(app.dbFile) {
+					app.onDBFileChanged("inotify overflow")
 				}
-
-				return false
+				continue
 			}
 
-			if ignoreFN() {
-				app.LogDebug("Ignoring file-change - event is explicitly ignored")
+			app.LogError("Filewatcher reported an error", err)
+		}
+	}
+}
+
+// runPollingWatcher checks size+mtime of the database every config.PollInterval (for filesystems without inotify)
+func (app *Application) runPollingWatcher() error {
+	app.LogInfo(fmt.Sprintf("Starting polling file-watcher (interval: %s)", app.pollInterval()))
+
+	var last *fileSample = nil
+	if fi, err := os.Stat(app.dbFile); err == nil {
+		last = &fileSample{Size: fi.Size(), ModTime: fi.ModTime()}
+	}
+
+	for {
+		select {
+		case <-app.sigSyncLoopStopChan:
+			app.LogInfo("Stopping sync loop (received signal)")
+			return nil
+
+		case <-time.After(app.pollInterval()):
+			fi, err := os.Stat(app.dbFile)
+			if err != nil {
+				if last != nil {
+					app.LogWarn("Database file was moved away or deleted - waiting for it to re-appear")
+				}
+				last = nil
 				continue
 			}
 
-			app.uploadWaiting.Set(true)
-			app.setTrayStateDirect("Uploading database (waiting)", assets.IconUpload)
-			app.LogInfo(fmt.Sprintf("Database file was modified - requesting upload (currently %d pending requests)", app.uploadDCI.CountPendingRequests()))
-			app.uploadDCI.Request()
+			curr := fileSample{Size: fi.Size(), ModTime: fi.ModTime()}
 
-		case err := <-watcher.Errors:
-			app.LogError("Filewatcher reported an error", err)
+			if last == nil || *last != curr {
+				app.LogDebug(fmt.Sprintf("Polling detected change: size=%d mtime=%s", curr.Size, curr.ModTime.Format(time.RFC3339Nano)))
+				app.onDBFileChanged("poll")
+			}
+
+			last = &curr
 		}
 	}
 }
+
+func (app *Application) pollInterval() time.Duration {
+	if app.cfg().PollInterval <= 0 {
+		return 2 * time.Second
+	}
+	return timeext.FromMilliseconds(app.cfg().PollInterval)
+}
+
+// onDBFileChanged requests an upload after the database file was (possibly) modified
+func (app *Application) onDBFileChanged(source string) {
+	localCS, err := app.calcLocalChecksum()
+	if err != nil {
+		app.LogError("Failed to calculate local database checksum", err)
+		app.showErrorNotification("KeePassSync: Error", "Failed to calculate checksum")
+		return
+	}
+
+	ignoreFN := func() bool {
+		app.masterLock.Lock()
+		defer app.masterLock.Unlock()
+
+		for _, ign := range app.fileWatcherIgnore {
+			if ign.V2 == localCS && time.Since(ign.V1) < 10*time.Second {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if ignoreFN() {
+		app.LogDebug("Ignoring file-change - event is explicitly ignored")
+		return
+	}
+
+	if app.syncPaused.Get() {
+		app.LogInfo(fmt.Sprintf("Database file was modified (%s) - sync is paused, not uploading", source))
+		return
+	}
+
+	if state := app.readState(); state != nil && state.Checksum == localCS && !app.uploadDCI.HasPendingRequests() {
+		app.LogDebug(fmt.Sprintf("Ignoring file-change (%s) - database still matches remote (via checksum)", source))
+		return
+	}
+
+	app.uploadWaiting.Set(true)
+	app.setTrayStateDirect("Uploading database (waiting)", assets.IconUpload)
+	app.LogInfo(fmt.Sprintf("Database file was modified (%s) - requesting upload (currently %d pending requests)", source, app.uploadDCI.CountPendingRequests()))
+	app.uploadDCI.Request()
+}
+
+// inotifyUnsupported returns true if dir is on a filesystem where inotify is known to be unreliable
+func inotifyUnsupported(dir string) (string, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return "", false
+	}
+
+	if fs, ok := inotifyUnsupportedFilesystems[uint32(st.Type)]; ok {
+		return fs, true
+	}
+
+	return "", false
+}
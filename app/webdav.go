@@ -2,109 +2,345 @@ package app
 
 import (
 	"bytes"
+	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"git.blackforestbytes.com/BlackForestBytes/goext/cryptext"
 	"git.blackforestbytes.com/BlackForestBytes/goext/dataext"
 	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
 	"git.blackforestbytes.com/BlackForestBytes/goext/timeext"
 )
 
 var ETagConflictError = errors.New("ETag conflict")
 
-func (app *Application) downloadDatabase() (string, time.Time, string, int64, error) {
+var NotModifiedError = errors.New("Not modified")
 
-	prevTT := app.currSysTrayTooltip
-	defer app.setTrayTooltip(prevTT)
+const (
+	downloadMaxFailures   = 5
+	downloadHeaderTimeout = 60 * time.Second // max time until the response headers are received
+	downloadIdleTimeout   = 60 * time.Second // max time without receiving any data of the body
+)
 
-	client := http.Client{Timeout: 90 * time.Second}
+// downloadDatabase downloads the remote database to app.dbFile.
+// If etagIfNoneMatch is set and the remote file still has this ETag, NotModifiedError is returned (and nothing is written).
+func (app *Application) downloadDatabase(op *syncOp, etagIfNoneMatch *string) (string, time.Time, string, int64, error) {
 
-	req, err := http.NewRequest("GET", app.config.WebDAVURL, nil)
+	etag, lm, sha, sz, err := app.downloadToPartial(op, etagIfNoneMatch)
+	if errors.Is(err, NotModifiedError) {
+		return "", time.Time{}, "", 0, NotModifiedError
+	}
+	if errors.Is(err, InvalidDatabaseError) {
+		return "", time.Time{}, "", 0, InvalidDatabaseError // already reported by rejectInvalidDatabase
+	}
 	if err != nil {
 		return "", time.Time{}, "", 0, exerr.Wrap(err, "").Build()
 	}
 
-	req.SetBasicAuth(app.config.WebDAVUser, app.config.WebDAVPass)
-
-	t0 := time.Now()
-	app.LogDebug(fmt.Sprintf("{HTTP} Starting WebDAV download..."))
-
-	resp, err := client.Do(req)
+	err = app.replaceLocalDatabase(sha)
 	if err != nil {
-		return "", time.Time{}, "", 0, exerr.Wrap(err, "Failed to download remote database").Build()
+		return "", time.Time{}, "", 0, exerr.Wrap(err, "").Build()
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", time.Time{}, "", 0, exerr.New(exerr.TypeInternal, "Failed to download remote database").Int("sc", resp.StatusCode).Build()
+	return etag, lm, sha, sz, nil
+}
+
+// downloadToPartial downloads the remote database into app.partialFile.
+// If the connection drops the download is resumed (Range + If-Range) instead of restarted,
+// a partial file left over from a previous run is resumed as well.
+// A download is only resumed if the server advertises the SHA-256 of the file (Nextcloud `OC-Checksum`),
+// the reassembled file is verified against it. Without a checksum an interrupted download restarts from zero.
+// There is no limit for the total duration, only for the response headers and for a stalled body (no data for downloadIdleTimeout).
+func (app *Application) downloadToPartial(op *syncOp, etagIfNoneMatch *string) (string, time.Time, string, int64, error) {
+
+	prevTT := app.currSysTrayTooltip
+	defer app.setTrayTooltip(prevTT)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = downloadHeaderTimeout
+	client := http.Client{Transport: transport}
+
+	pstate := app.readPartialState()
+	if pstate != nil && pstate.Checksum == "" {
+		pstate = nil // a resumed file can't be verified without the checksum of the server
 	}
 
-	currTT := ""
-	progressCallback := func(current int64, total int64) {
-		newTT := fmt.Sprintf("Downloading (%.0f%%)", float64(current)/float64(total)*100)
-		if currTT != newTT {
-			app.setTrayTooltip(newTT)
-			currTT = newTT
+	offset := int64(0)
+	if pstate != nil {
+		if fi, err := os.Stat(app.partialFile); err == nil && fi.Size() < pstate.Size {
+			offset = fi.Size()
+		} else {
+			pstate = nil
 		}
 	}
 
-	bin, err := ReadAllWithProgress(resp.Body, resp.ContentLength, progressCallback)
-	if err != nil {
-		return "", time.Time{}, "", 0, exerr.Wrap(err, "Failed to read response body").Build()
+	if pstate != nil && offset > 0 {
+		op.LogInfo(fmt.Sprintf("Found partial download - trying to resume at %s / %s", langext.FormatBytes(offset), langext.FormatBytes(pstate.Size)))
+	}
+
+	t0 := time.Now()
+	op.LogDebug(fmt.Sprintf("{HTTP} Starting WebDAV download..."))
+
+	failures := 0
+	for {
+
+		req, err := http.NewRequest("GET", app.cfg().WebDAVURL, nil)
+		if err != nil {
+			return "", time.Time{}, "", 0, exerr.Wrap(err, "").Build()
+		}
+
+		req.SetBasicAuth(app.cfg().WebDAVUser, app.cfg().WebDAVPass)
+
+		if etagIfNoneMatch != nil {
+			req.Header.Set("If-None-Match", etagHeader(*etagIfNoneMatch))
+		}
+
+		if pstate != nil && offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			if pstate.ETagHeader != "" {
+				req.Header.Set("If-Range", pstate.ETagHeader) // unchanged - a weak ETag (W/"...") never matches and the server sends the full file
+			} else {
+				req.Header.Set("If-Range", etagHeader(pstate.ETag))
+			}
+		}
+
+		n, done, err := func() (int64, bool, error) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			idle := time.AfterFunc(downloadIdleTimeout, cancel) // reset on every read (idleTimeoutReader)
+			defer idle.Stop()
+
+			resp, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				return 0, false, exerr.Wrap(err, "Failed to download remote database").Build()
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			openFlags := os.O_CREATE | os.O_WRONLY
+
+			if resp.StatusCode == http.StatusNotModified {
+
+				op.LogDebugWith("{HTTP} Remote database not modified", F("status_code", resp.StatusCode), F("duration", time.Since(t0)))
+				return 0, true, NotModifiedError
+
+			} else if resp.StatusCode == http.StatusOK {
+
+				if offset > 0 {
+					op.LogInfo("Remote database changed since partial download (or server does not support ranges) - restarting download")
+				}
+
+				etag, lm, err := app.parseHeader(op, resp)
+				if err != nil {
+					return 0, true, exerr.Wrap(err, "").Build()
+				}
+
+				pstate = &PartialState{ETag: etag, ETagHeader: strings.TrimSpace(resp.Header.Get("ETag")), LastModified: lm, Size: resp.ContentLength, Checksum: parseChecksumHeader(resp)}
+				offset = 0
+				openFlags |= os.O_TRUNC
+
+				err = app.savePartialState(*pstate)
+				if err != nil {
+					return 0, true, exerr.Wrap(err, "").Build()
+				}
+
+			} else if resp.StatusCode == http.StatusPartialContent && pstate != nil {
+
+				start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+				if err != nil {
+					return 0, true, exerr.Wrap(err, "").Build()
+				}
+				if start != offset || (pstate.Size >= 0 && total >= 0 && total != pstate.Size) {
+					op.LogWarn(fmt.Sprintf("Server returned unexpected range (start: %d, total: %d) - restarting download", start, total))
+					pstate = nil
+					offset = 0
+					return 0, false, nil
+				}
+
+				op.LogDebug(fmt.Sprintf("{HTTP} Resuming download at %d", offset))
+				openFlags |= os.O_APPEND
+
+			} else if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+
+				op.LogWarn("Server rejected range request - restarting download")
+				pstate = nil
+				offset = 0
+				return 0, false, nil
+
+			} else {
+				return 0, true, exerr.New(exerr.TypeInternal, "Failed to download remote database").Int("sc", resp.StatusCode).Build()
+			}
+
+			f, err := os.OpenFile(app.partialFile, openFlags, 0644)
+			if err != nil {
+				return 0, true, exerr.Wrap(err, "Failed to open partial download file").Build()
+			}
+			defer func() { _ = f.Close() }()
+
+			base := offset
+			currTT := ""
+			progressCallback := func(current int64, total int64) {
+				newTT := fmt.Sprintf("Downloading (%.0f%%)", float64(base+current)/float64(total)*100)
+				if currTT != newTT {
+					app.setTrayTooltip(newTT)
+					currTT = newTT
+				}
+			}
+
+			n, err := io.Copy(f, NewProgressReader(newIdleTimeoutReader(resp.Body, idle, downloadIdleTimeout), pstate.Size, progressCallback))
+			if err != nil {
+				return n, false, exerr.Wrap(err, "Failed to read response body").Build()
+			}
+
+			return n, false, nil
+		}()
+
+		offset += n
+
+		if errors.Is(err, NotModifiedError) {
+			if pstate != nil {
+				app.discardPartialDownload() // the partial file belongs to a different remote version
+			}
+			return "", time.Time{}, "", 0, NotModifiedError
+		}
+
+		if err != nil && done {
+			return "", time.Time{}, "", 0, err
+		}
+
+		if err == nil && pstate != nil && (pstate.Size < 0 || offset == pstate.Size) {
+			break
+		}
+
+		resumable := pstate != nil && pstate.Checksum != ""
+
+		if n > 0 && resumable {
+			failures = 0
+		} else {
+			failures++
+		}
+
+		if !resumable && offset > 0 {
+			op.LogWarn("Server sent no checksum (OC-Checksum) - the download can't be resumed (and verified), restarting it")
+			offset = 0
+		}
+
+		if failures >= downloadMaxFailures {
+			if err == nil {
+				err = exerr.New(exerr.TypeInternal, "Download made no progress").Build()
+			}
+			return "", time.Time{}, "", 0, exerr.Wrap(err, fmt.Sprintf("Failed to download remote database (giving up after %d attempts)", failures)).Build()
+		}
+
+		if err != nil {
+			op.LogErrorWith(fmt.Sprintf("Download interrupted at %s - retrying", langext.FormatBytes(offset)), err, F("offset", offset), F("attempt", failures+1))
+		}
+
+		time.Sleep(time.Duration(failures) * time.Second)
 	}
 
-	app.LogDebug(fmt.Sprintf("{HTTP} Finished WebDAV download in %s", time.Since(t0)))
+	op.LogDebugWith("{HTTP} Finished WebDAV download", F("duration", time.Since(t0)))
 
-	etag, lm, err := app.parseHeader(resp)
+	bin, err := os.ReadFile(app.partialFile)
 	if err != nil {
-		return "", time.Time{}, "", 0, exerr.Wrap(err, "").Build()
+		return "", time.Time{}, "", 0, exerr.Wrap(err, "Failed to read partial download file").Build()
 	}
 
 	sha := cryptext.BytesSha256(bin)
 
 	sz := int64(len(bin))
 
+	if err := validateKDBX(bin); err != nil {
+		app.rejectInvalidDatabase(op, bin, "replace the local database with the downloaded file", err)
+		app.discardPartialDownload()
+		return "", time.Time{}, "", 0, InvalidDatabaseError
+	}
+
+	if pstate.Size >= 0 && sz != pstate.Size {
+		app.discardPartialDownload()
+		return "", time.Time{}, "", 0, exerr.New(exerr.TypeInternal, "Downloaded file has unexpected size").Int64("expected", pstate.Size).Int64("actual", sz).Build()
+	}
+
+	if pstate.Checksum == "" {
+		op.LogDebug("Server sent no checksum (OC-Checksum) - downloaded in one piece, not verified")
+	} else if !strings.EqualFold(pstate.Checksum, sha) {
+		app.discardPartialDownload()
+		return "", time.Time{}, "", 0, exerr.New(exerr.TypeInternal, "Checksum mismatch in downloaded file").Str("expected", pstate.Checksum).Str("actual", sha).Build()
+	}
+
+	return pstate.ETag, pstate.LastModified, sha, sz, nil
+}
+
+// replaceLocalDatabase atomically moves the (completed) partial download over app.dbFile
+func (app *Application) replaceLocalDatabase(sha string) error {
 	app.masterLock.Lock()
 	app.fileWatcherIgnore = append(app.fileWatcherIgnore, dataext.NewTuple(time.Now(), sha))
 	app.masterLock.Unlock()
 
-	err = os.WriteFile(app.dbFile, bin, 0644)
+	err := os.Rename(app.partialFile, app.dbFile)
 	if err != nil {
-		return "", time.Time{}, "", 0, exerr.Wrap(err, "Failed to write database file").Build()
+		return exerr.Wrap(err, "Failed to write database file").Build()
 	}
 
-	return etag, lm, sha, sz, nil
+	app.discardPartialDownload()
+
+	return nil
 }
 
-func (app *Application) getRemoteState() (string, time.Time, error) {
+// fetchRemoteDatabase downloads the remote database into memory (the local files are not touched)
+func (app *Application) fetchRemoteDatabase(op *syncOp) ([]byte, error) {
+	resp, err := app.davRequest(op, "GET", app.cfg().WebDAVURL, nil, nil)
+	if err != nil {
+		return nil, exerr.Wrap(err, "").Build()
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, exerr.New(exerr.TypeInternal, "Failed to download remote database").Int("sc", resp.StatusCode).Build()
+	}
+
+	bin, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, exerr.Wrap(err, "Failed to read response body").Build()
+	}
+
+	return bin, nil
+}
+
+func (app *Application) getRemoteState(op *syncOp) (string, time.Time, error) {
 	client := http.Client{Timeout: 90 * time.Second}
 
-	req, err := http.NewRequest("HEAD", app.config.WebDAVURL, nil)
+	req, err := http.NewRequest("HEAD", app.cfg().WebDAVURL, nil)
 	if err != nil {
 		return "", time.Time{}, exerr.Wrap(err, "").Build()
 	}
 
-	req.SetBasicAuth(app.config.WebDAVUser, app.config.WebDAVPass)
+	req.SetBasicAuth(app.cfg().WebDAVUser, app.cfg().WebDAVPass)
 
 	t0 := time.Now()
-	app.LogDebug(fmt.Sprintf("{HTTP} Starting WebDAV HEAD-request..."))
+	op.LogDebug(fmt.Sprintf("{HTTP} Starting WebDAV HEAD-request..."))
 
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", time.Time{}, exerr.Wrap(err, "Failed to download remote database").Build()
 	}
 
-	app.LogDebug(fmt.Sprintf("{HTTP} Finished WebDAV request in %s", time.Since(t0)))
+	op.LogDebugWith("{HTTP} Finished WebDAV HEAD-request", F("status_code", resp.StatusCode), F("duration", time.Since(t0)))
 
 	if resp.StatusCode != http.StatusOK {
 		return "", time.Time{}, exerr.New(exerr.TypeInternal, "Failed to download remote database").Int("sc", resp.StatusCode).Build()
 	}
 
-	etag, lm, err := app.parseHeader(resp)
+	etag, lm, err := app.parseHeader(op, resp)
 	if err != nil {
 		return "", time.Time{}, exerr.Wrap(err, "").Build()
 	}
@@ -112,22 +348,22 @@ func (app *Application) getRemoteState() (string, time.Time, error) {
 	return etag, lm, nil
 }
 
-func (app *Application) uploadDatabase(etagIfMatch *string) (string, time.Time, string, int64, error) {
+func (app *Application) uploadDatabase(op *syncOp, etagIfMatch *string) (string, time.Time, string, int64, error) {
 
 	prevTT := app.currSysTrayTooltip
 	defer app.setTrayTooltip(prevTT)
 
 	client := http.Client{Timeout: 90 * time.Second}
 
-	req, err := http.NewRequest("PUT", app.config.WebDAVURL, nil)
+	req, err := http.NewRequest("PUT", app.cfg().WebDAVURL, nil)
 	if err != nil {
 		return "", time.Time{}, "", 0, exerr.Wrap(err, "").Build()
 	}
 
-	req.SetBasicAuth(app.config.WebDAVUser, app.config.WebDAVPass)
+	req.SetBasicAuth(app.cfg().WebDAVUser, app.cfg().WebDAVPass)
 
 	if etagIfMatch != nil {
-		req.Header.Set("If-Match", "\""+*etagIfMatch+"\"")
+		req.Header.Set("If-Match", etagHeader(*etagIfMatch))
 	}
 
 	bin, err := os.ReadFile(app.dbFile)
@@ -135,6 +371,11 @@ func (app *Application) uploadDatabase(etagIfMatch *string) (string, time.Time,
 		return "", time.Time{}, "", 0, exerr.Wrap(err, "Failed to read database file").Build()
 	}
 
+	if err := validateKDBX(bin); err != nil {
+		app.rejectInvalidDatabase(op, bin, "upload the local database", err)
+		return "", time.Time{}, "", 0, InvalidDatabaseError
+	}
+
 	sha := cryptext.BytesSha256(bin)
 
 	sz := int64(len(bin))
@@ -152,7 +393,7 @@ func (app *Application) uploadDatabase(etagIfMatch *string) (string, time.Time,
 	req.Body = NewProgressReader(bytes.NewReader(bin), int64(len(bin)), progressCallback)
 
 	t0 := time.Now()
-	app.LogDebug(fmt.Sprintf("{HTTP} Starting WebDAV upload..."))
+	op.LogDebug(fmt.Sprintf("{HTTP} Starting WebDAV upload..."))
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -160,11 +401,11 @@ func (app *Application) uploadDatabase(etagIfMatch *string) (string, time.Time,
 	}
 	defer func() { _ = resp.Body.Close() }()
 
-	app.LogDebug(fmt.Sprintf("{HTTP} Finished WebDAV upload in %s", time.Since(t0)))
+	op.LogDebugWith("{HTTP} Finished WebDAV upload", F("status_code", resp.StatusCode), F("size", sz), F("duration", time.Since(t0)))
 
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusNoContent {
 
-		etag, lm, err := app.parseHeader(resp)
+		etag, lm, err := app.parseHeader(op, resp)
 		if err != nil {
 			return "", time.Time{}, "", 0, exerr.Wrap(err, "").Build()
 		}
@@ -179,21 +420,20 @@ func (app *Application) uploadDatabase(etagIfMatch *string) (string, time.Time,
 	return "", time.Time{}, "", 0, exerr.New(exerr.TypeInternal, fmt.Sprintf("Failed to upload remote database (statuscode: %d)", resp.StatusCode)).Int("sc", resp.StatusCode).Build()
 }
 
-func (app *Application) parseHeader(resp *http.Response) (string, time.Time, error) {
+func (app *Application) parseHeader(op *syncOp, resp *http.Response) (string, time.Time, error) {
 	var err error
 
-	etag := resp.Header.Get("ETag")
+	etag := parseETag(resp.Header.Get("ETag"))
 	if etag == "" {
 		return "", time.Time{}, exerr.New(exerr.TypeInternal, "ETag header is missing").Build()
 	}
-	etag = strings.Trim(etag, "\"\r\n ")
 
 	var lm time.Time
 
 	lmStr := resp.Header.Get("Last-Modified")
 	if lmStr == "" {
 		lm = time.Now().In(timeext.TimezoneBerlin)
-		app.LogDebug("Last-Modified header is missing, using current time as fallback")
+		op.LogDebug("Last-Modified header is missing, using current time as fallback")
 	} else {
 		lm, err = time.Parse("Mon, 02 Jan 2006 15:04:05 MST", lmStr)
 		if err != nil {
@@ -204,3 +444,229 @@ func (app *Application) parseHeader(resp *http.Response) (string, time.Time, err
 
 	return etag, lm, nil
 }
+
+// parseETag returns the ETag of an ETag header as it is stored (kpsync.state):
+// a strong ETag without its quotes, a weak ETag unchanged (W/"..."), etagHeader restores the header value.
+func parseETag(v string) string {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "W/") {
+		return v
+	}
+	return strings.Trim(v, "\"")
+}
+
+// etagHeader formats a stored ETag (see parseETag) for If-Match / If-None-Match / If-Range
+func etagHeader(etag string) string {
+	if strings.HasPrefix(etag, "W/") || strings.HasPrefix(etag, "\"") {
+		return etag
+	}
+	return "\"" + etag + "\""
+}
+
+// parseContentRange parses a `Content-Range: bytes {start}-{end}/{total}` header (total is -1 if unknown)
+func parseContentRange(v string) (int64, int64, error) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, exerr.New(exerr.TypeInternal, "Invalid Content-Range header").Str("value", v).Build()
+	}
+
+	rng, totalStr, ok := strings.Cut(strings.TrimPrefix(v, "bytes "), "/")
+	if !ok {
+		return 0, 0, exerr.New(exerr.TypeInternal, "Invalid Content-Range header").Str("value", v).Build()
+	}
+
+	startStr, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, exerr.New(exerr.TypeInternal, "Invalid Content-Range header").Str("value", v).Build()
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, exerr.Wrap(err, "Invalid Content-Range header").Str("value", v).Build()
+	}
+
+	total := int64(-1)
+	if totalStr != "*" {
+		total, err = strconv.ParseInt(totalStr, 10, 64)
+		if err != nil {
+			return 0, 0, exerr.Wrap(err, "Invalid Content-Range header").Str("value", v).Build()
+		}
+	}
+
+	return start, total, nil
+}
+
+// parseChecksumHeader returns the SHA-256 checksum advertised by the server (Nextcloud `OC-Checksum`), or "" if there is none
+func parseChecksumHeader(resp *http.Response) string {
+	for _, v := range strings.Fields(resp.Header.Get("OC-Checksum")) {
+		if algo, sum, ok := strings.Cut(v, ":"); ok && strings.EqualFold(algo, "SHA256") {
+			return strings.ToLower(sum)
+		}
+	}
+	return ""
+}
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"DAV: href"`
+	Propstat []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength  int64  `xml:"DAV: getcontentlength"`
+	ETag           string `xml:"DAV: getetag"`
+	LastModified   string `xml:"DAV: getlastmodified"`
+	QuotaUsed      int64  `xml:"DAV: quota-used-bytes"`
+	QuotaAvailable int64  `xml:"DAV: quota-available-bytes"`
+}
+
+// DAVEntry is a file or directory returned by davPropfind
+type DAVEntry struct {
+	URL            string
+	IsDir          bool
+	Size           int64
+	ETag           string
+	QuotaUsed      int64
+	QuotaAvailable int64 // negative values have special meanings (e.g. -3 = unlimited on Nextcloud)
+}
+
+const davPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getetag/>
+    <d:getlastmodified/>
+    <d:quota-used-bytes/>
+    <d:quota-available-bytes/>
+  </d:prop>
+</d:propfind>`
+
+// davRequest sends a request to the WebDAV server (with the configured credentials), the caller must close the body
+func (app *Application) davRequest(op *syncOp, method string, u string, headers map[string]string, body []byte) (*http.Response, error) {
+	client := http.Client{Timeout: 90 * time.Second}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, exerr.Wrap(err, "").Build()
+	}
+
+	req.SetBasicAuth(app.cfg().WebDAVUser, app.cfg().WebDAVPass)
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	t0 := time.Now()
+	op.LogDebug(fmt.Sprintf("{HTTP} Starting WebDAV %s-request (%s)...", method, u))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, exerr.Wrap(err, "WebDAV request failed").Str("method", method).Build()
+	}
+
+	op.LogDebugWith("{HTTP} Finished WebDAV request", F("method", method), F("status_code", resp.StatusCode), F("duration", time.Since(t0)))
+
+	return resp, nil
+}
+
+// davPropfind lists the resource u (depth "0") or u and its direct children (depth "1")
+func (app *Application) davPropfind(op *syncOp, u string, depth string) ([]DAVEntry, error) {
+	base, err := url.Parse(u)
+	if err != nil {
+		return nil, exerr.Wrap(err, "Invalid URL").Str("url", u).Build()
+	}
+
+	resp, err := app.davRequest(op, "PROPFIND", u, map[string]string{"Depth": depth, "Content-Type": "application/xml; charset=utf-8"}, []byte(davPropfindBody))
+	if err != nil {
+		return nil, exerr.Wrap(err, "").Build()
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, exerr.New(exerr.TypeInternal, fmt.Sprintf("PROPFIND failed (statuscode: %d)", resp.StatusCode)).Int("sc", resp.StatusCode).Build()
+	}
+
+	bin, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, exerr.Wrap(err, "Failed to read PROPFIND response").Build()
+	}
+
+	var ms davMultistatus
+	err = xml.Unmarshal(bin, &ms)
+	if err != nil {
+		return nil, exerr.Wrap(err, "Failed to parse PROPFIND response").Build()
+	}
+
+	res := make([]DAVEntry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		ref, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+
+		entry := DAVEntry{URL: base.ResolveReference(ref).String()}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			entry.IsDir = ps.Prop.ResourceType.Collection != nil
+			entry.Size = ps.Prop.ContentLength
+			entry.ETag = parseETag(ps.Prop.ETag)
+			entry.QuotaUsed = ps.Prop.QuotaUsed
+			entry.QuotaAvailable = ps.Prop.QuotaAvailable
+		}
+
+		res = append(res, entry)
+	}
+
+	return res, nil
+}
+
+// probeConditionalWrite creates a scratch file in the directory dirURL and checks that the server
+// accepts writes and honors If-Match (a PUT with a stale ETag must fail with 412).
+// The scratch file is deleted afterwards. Returns (canWrite, ifMatchHonored, err).
+func (app *Application) probeConditionalWrite(op *syncOp, dirURL string) (bool, bool, error) {
+	scratch := strings.TrimSuffix(dirURL, "/") + "/.kpsync-probe-" + langext.RandBase62(8)
+
+	resp, err := app.davRequest(op, "PUT", scratch, map[string]string{"If-None-Match": "*"}, []byte("kpsync write probe (v1)\n"))
+	if err != nil {
+		return false, false, exerr.Wrap(err, "").Build()
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return false, false, exerr.New(exerr.TypeInternal, fmt.Sprintf("Failed to create scratch file (statuscode: %d)", resp.StatusCode)).Int("sc", resp.StatusCode).Build()
+	}
+
+	defer func() {
+		resp, err := app.davRequest(op, "DELETE", scratch, nil, nil)
+		if err != nil {
+			op.LogError("Failed to delete scratch file "+scratch, err)
+			return
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			op.LogError(fmt.Sprintf("Failed to delete scratch file %s (statuscode: %d)", scratch, resp.StatusCode), nil)
+		}
+	}()
+
+	resp, err = app.davRequest(op, "PUT", scratch, map[string]string{"If-Match": "\"kpsync-stale-etag\""}, []byte("kpsync write probe (v2)\n"))
+	if err != nil {
+		return true, false, exerr.Wrap(err, "").Build()
+	}
+	_ = resp.Body.Close()
+
+	return true, resp.StatusCode == http.StatusPreconditionFailed, nil
+}
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		wantStart int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{"full", "bytes 0-99/100", 0, 100, false},
+		{"resumed", "bytes 4096-8191/8192", 4096, 8192, false},
+		{"unknown total", "bytes 10-19/*", 10, -1, false},
+		{"surrounding whitespace", "  bytes 5-9/10 ", 5, 10, false},
+		{"empty", "", 0, 0, true},
+		{"wrong unit", "items 0-9/10", 0, 0, true},
+		{"missing total", "bytes 0-9", 0, 0, true},
+		{"missing end", "bytes 0/10", 0, 0, true},
+		{"invalid start", "bytes x-9/10", 0, 0, true},
+		{"invalid total", "bytes 0-9/ten", 0, 0, true},
+		{"unsatisfied range", "bytes */100", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, total, err := parseContentRange(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseContentRange(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if err == nil && (start != tt.wantStart || total != tt.wantTotal) {
+				t.Errorf("parseContentRange(%q) = (%d, %d), want (%d, %d)", tt.value, start, total, tt.wantStart, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestParseChecksumHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"missing", "", ""},
+		{"sha256", "SHA256:ABCDEF0123", "abcdef0123"},
+		{"sha256 lowercase algo", "sha256:abcdef0123", "abcdef0123"},
+		{"multiple algos", "SHA1:1111 MD5:2222 SHA256:3333", "3333"},
+		{"only other algos", "SHA1:1111 MD5:2222", ""},
+		{"invalid entry", "SHA256", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.value != "" {
+				resp.Header.Set("OC-Checksum", tt.value)
+			}
+			if got := parseChecksumHeader(resp); got != tt.want {
+				t.Errorf("parseChecksumHeader(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestETagHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		want   string
+	}{
+		{"strong", `"6543f1c2a"`, "6543f1c2a", `"6543f1c2a"`},
+		{"strong with whitespace", " \"6543f1c2a\"\r\n", "6543f1c2a", `"6543f1c2a"`},
+		{"weak", `W/"6543f1c2a"`, `W/"6543f1c2a"`, `W/"6543f1c2a"`},
+		{"weak with whitespace", ` W/"6543f1c2a" `, `W/"6543f1c2a"`, `W/"6543f1c2a"`},
+		{"unquoted", "6543f1c2a", "6543f1c2a", `"6543f1c2a"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etag := parseETag(tt.header)
+			if etag != tt.etag {
+				t.Errorf("parseETag(%q) = %q, want %q", tt.header, etag, tt.etag)
+			}
+			if got := etagHeader(etag); got != tt.want {
+				t.Errorf("etagHeader(%q) = %q, want %q", etag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadToPartialResume(t *testing.T) {
+	content := kdbxTestFile4(kdbxTestFields4(), make([]byte, 4096))
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name        string
+		checksum    string
+		wantResumed bool
+	}{
+		{"with checksum", checksum, true},
+		{"without checksum", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make([]*http.Request, 0)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, r)
+
+				w.Header().Set("ETag", `W/"v1"`)
+				if tt.checksum != "" {
+					w.Header().Set("OC-Checksum", "SHA256:"+tt.checksum)
+				}
+
+				if len(requests) == 1 {
+					// connection drops after half of the file
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+					w.WriteHeader(http.StatusOK)
+					_, _ = w.Write(content[:len(content)/2])
+					panic(http.ErrAbortHandler)
+				}
+
+				if rng := r.Header.Get("Range"); rng != "" {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", len(content)/2, len(content)-1, len(content)))
+					w.WriteHeader(http.StatusPartialContent)
+					_, _ = w.Write(content[len(content)/2:])
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(content)
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+
+			app := NewApplication()
+			app.setConfig(Config{WebDAVURL: srv.URL + "/db.kdbx", WorkDir: dir, LogLevel: string(LogLevelError)})
+			app.partialFile = path.Join(dir, "kpsync.download")
+			app.partialStateFile = path.Join(dir, "kpsync.download.state")
+
+			op := app.beginOperation("test")
+			defer op.End()
+
+			_, _, sha, sz, err := app.downloadToPartial(op, nil)
+			if err != nil {
+				t.Fatalf("downloadToPartial() failed: %v", err)
+			}
+			if sha != checksum || sz != int64(len(content)) {
+				t.Errorf("downloadToPartial() = (%s, %d), want (%s, %d)", sha, sz, checksum, len(content))
+			}
+
+			if len(requests) != 2 {
+				t.Fatalf("expected 2 requests, got %d", len(requests))
+			}
+
+			rng, ifRange := requests[1].Header.Get("Range"), requests[1].Header.Get("If-Range")
+			if tt.wantResumed {
+				if rng != fmt.Sprintf("bytes=%d-", len(content)/2) {
+					t.Errorf("Range = %q, want the download to be resumed", rng)
+				}
+				if ifRange != `W/"v1"` {
+					t.Errorf("If-Range = %q, want the unchanged ETag header", ifRange)
+				}
+			} else if rng != "" {
+				t.Errorf("Range = %q, a download without checksum must not be resumed", rng)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
+)
+
+const (
+	wizardMaxDepth = 4   // how deep the DAV root is searched for databases
+	wizardMaxDirs  = 250 // max directories to list while searching for databases
+)
+
+// RunInit implements `kpsync init`: an interactive wizard that asks for the server and credentials,
+// finds the database on the server, tests read + (conditional) write access and writes the config file
+func (app *Application) RunInit(args []string) int {
+	app.headless = true
+
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	configPath := fs.String("config", xdgConfigPath(), "Path to the configuration file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfgPath := expandHome(*configPath)
+
+	in := bufio.NewReader(os.Stdin)
+
+	fmt.Println("kpsync - configuration wizard")
+	fmt.Println()
+
+	if fileExists(cfgPath) {
+		if !wizardConfirm(in, fmt.Sprintf("A config already exists at %s - overwrite it?", cfgPath), false) {
+			fmt.Println("Aborted.")
+			return 1
+		}
+	}
+
+	serverURL := wizardPrompt(in, "WebDAV URL (DAV root, a directory or the .kdbx file)", "")
+	if serverURL == "" {
+		fmt.Println("Aborted (no URL).")
+		return 1
+	}
+	if _, err := url.ParseRequestURI(serverURL); err != nil {
+		fmt.Printf("Invalid URL: %s\n", err.Error())
+		return 1
+	}
+
+	wcfg := *app.cfg() // davRequest uses the credentials of the current config
+	wcfg.WebDAVURL = serverURL
+	wcfg.WebDAVUser = wizardPrompt(in, "Username", "")
+	wcfg.WebDAVPass = wizardPromptSecret(in, "Password (or app-password)")
+	app.setConfig(wcfg)
+
+	dbURL := serverURL
+	if !strings.HasSuffix(strings.ToLower(serverURL), ".kdbx") {
+		fmt.Println()
+		fmt.Println("Searching for databases (PROPFIND)...")
+
+		found, err := app.findRemoteDatabases(serverURL)
+		if err != nil {
+			fmt.Printf("[FAIL] Failed to list %s: %s\n", serverURL, err.Error())
+			return 1
+		}
+		if len(found) == 0 {
+			fmt.Println("[FAIL] No .kdbx files found - enter the URL of the database directly")
+			return 1
+		}
+
+		for i, e := range found {
+			fmt.Printf("  [%d] %s (%d bytes)\n", i+1, e.URL, e.Size)
+		}
+
+		idx := 1
+		if len(found) > 1 {
+			v, err := strconv.Atoi(wizardPrompt(in, "Database", "1"))
+			if err != nil || v < 1 || v > len(found) {
+				fmt.Println("Invalid choice.")
+				return 1
+			}
+			idx = v
+		}
+		dbURL = found[idx-1].URL
+	}
+
+	wcfg.WebDAVURL = dbURL
+	app.setConfig(wcfg)
+
+	fmt.Println()
+	fmt.Printf("Testing access to %s...\n", dbURL)
+
+	if !app.wizardTestAccess(dbURL) {
+		if !wizardConfirm(in, "The connection test failed - write the config anyway?", false) {
+			fmt.Println("Aborted.")
+			return 1
+		}
+	}
+
+	fmt.Println()
+
+	cfg := defaultConfig(dbURL, detectTerminalEmulator())
+	cfg.WebDAVUser = app.cfg().WebDAVUser
+	cfg.WebDAVPass = app.cfg().WebDAVPass
+
+	cfg.WorkDir = wizardPrompt(in, "Work directory", cfg.WorkDir)
+
+	if fb := wizardPrompt(in, "Local fallback database (optional)", ""); fb != "" {
+		cfg.LocalFallback = &fb
+	}
+
+	if cfg.TerminalEmulator != "" {
+		fmt.Printf("Detected terminal emulator: %s\n", cfg.TerminalEmulator)
+	} else {
+		cfg.TerminalEmulator = wizardPrompt(in, "Terminal emulator (no known terminal found, e.g. 'xterm -e')", "")
+	}
+
+	if !wizardCheckConfig(in, cfg) {
+		fmt.Println("Aborted.")
+		return 1
+	}
+
+	err := writeWizardConfig(cfgPath, cfg)
+	if err != nil {
+		fmt.Printf("[FAIL] Failed to write config: %s\n", err.Error())
+		return 2
+	}
+
+	fmt.Println()
+	fmt.Printf("Config written to %s (mode 0600)\n", cfgPath)
+	fmt.Println("Start `kpsync` to open the database.")
+
+	return 0
+}
+
+// findRemoteDatabases searches the directory rootURL (and its sub-directories) for .kdbx files
+func (app *Application) findRemoteDatabases(rootURL string) ([]DAVEntry, error) {
+	type queued struct {
+		url   string
+		depth int
+	}
+
+	res := make([]DAVEntry, 0)
+	queue := []queued{{strings.TrimSuffix(rootURL, "/") + "/", 0}}
+	visited := make(map[string]bool)
+
+	op := app.beginOperation("wizard-search")
+	defer op.End()
+
+	for len(queue) > 0 && len(visited) < wizardMaxDirs {
+		curr := queue[0]
+		queue = queue[1:]
+
+		if visited[curr.url] {
+			continue
+		}
+		visited[curr.url] = true
+
+		entries, err := app.davPropfind(op, curr.url, "1")
+		if err != nil {
+			if curr.depth == 0 {
+				return nil, exerr.Wrap(err, "").Build()
+			}
+			app.LogDebug(fmt.Sprintf("Failed to list %s: %s", curr.url, err.Error()))
+			continue
+		}
+
+		for _, e := range entries {
+			if strings.TrimSuffix(e.URL, "/") == strings.TrimSuffix(curr.url, "/") {
+				continue // the directory itself
+			}
+			if e.IsDir {
+				if curr.depth+1 < wizardMaxDepth && !strings.HasPrefix(path.Base(strings.TrimSuffix(e.URL, "/")), ".") {
+					queue = append(queue, queued{e.URL, curr.depth + 1})
+				}
+			} else if strings.HasSuffix(strings.ToLower(e.URL), ".kdbx") {
+				res = append(res, e)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// wizardTestAccess checks that the database can be read and that the server supports conditional writes
+func (app *Application) wizardTestAccess(dbURL string) bool {
+	ok := true
+
+	op := app.beginOperation("wizard-test")
+	defer op.End()
+
+	etag, _, err := app.getRemoteState(op)
+	if err != nil {
+		fmt.Printf("[FAIL] Read: %s\n", err.Error())
+		return false
+	}
+	fmt.Printf("[ OK ] Read (ETag: %s)\n", etag)
+
+	resp, err := app.davRequest(op, "GET", dbURL, nil, nil)
+	if err == nil {
+		bin, rerr := readAllAndClose(resp)
+		if rerr != nil {
+			fmt.Printf("[FAIL] Download: %s\n", rerr.Error())
+			ok = false
+		} else if verr := validateKDBX(bin); verr != nil {
+			fmt.Printf("[FAIL] The file is not a valid KeePass database: %s\n", verr.Error())
+			ok = false
+		} else {
+			fmt.Printf("[ OK ] Download (valid KeePass database, %d bytes)\n", len(bin))
+		}
+	} else {
+		fmt.Printf("[FAIL] Download: %s\n", err.Error())
+		ok = false
+	}
+
+	dirURL := dbURL[:strings.LastIndex(dbURL, "/")+1]
+
+	canWrite, ifMatch, err := app.probeConditionalWrite(op, dirURL)
+	if !canWrite {
+		fmt.Printf("[FAIL] Write: %s\n", errString(err))
+		ok = false
+	} else {
+		fmt.Printf("[ OK ] Write\n")
+		if ifMatch {
+			fmt.Printf("[ OK ] Conditional write (If-Match is honored)\n")
+		} else {
+			fmt.Printf("[FAIL] Conditional write: the server ignores If-Match - conflicts can't be detected\n")
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// wizardCheckConfig prints the problems of the generated config (validateConfig),
+// returns false if it has errors and the user does not want to write it anyway
+func wizardCheckConfig(in *bufio.Reader, cfg Config) bool {
+	problems := validateConfig(cfg, map[string]string{})
+	if len(problems) == 0 {
+		return true
+	}
+
+	hasErrors := false
+	fmt.Println()
+	for _, p := range problems {
+		if p.Severity == ConfigProblemError {
+			fmt.Printf("[FAIL] %s: %s\n", p.Key, p.Message)
+			hasErrors = true
+		} else {
+			fmt.Printf("[WARN] %s: %s\n", p.Key, p.Message)
+		}
+	}
+
+	if hasErrors {
+		return wizardConfirm(in, "The config has errors (kpsync won't start with it) - write it anyway?", false)
+	}
+	return true
+}
+
+func writeWizardConfig(cfgPath string, cfg Config) error {
+	bin, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+
+	if err := os.MkdirAll(path.Dir(cfgPath), 0700); err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+
+	tmp := cfgPath + ".tmp"
+	if err := os.WriteFile(tmp, bin, 0600); err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+	if err := os.Rename(tmp, cfgPath); err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+
+	// os.WriteFile does not change the mode of an existing file
+	if err := os.Chmod(cfgPath, 0600); err != nil {
+		return exerr.Wrap(err, "").Build()
+	}
+
+	return nil
+}
+
+func wizardPrompt(in *bufio.Reader, label string, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", label, def)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+
+	line, _ := in.ReadString('\n')
+	line = strings.TrimSpace(line)
+
+	if line == "" {
+		return def
+	}
+	return line
+}
+
+// wizardPromptSecret reads a line without echoing it (via `stty -echo`, if stdin is a terminal)
+func wizardPromptSecret(in *bufio.Reader, label string) string {
+	fmt.Printf("%s: ", label)
+
+	sttyCmd := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+
+	if sttyCmd("-echo") == nil {
+		defer func() {
+			_ = sttyCmd("echo")
+			fmt.Println()
+		}()
+	}
+
+	line, _ := in.ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+func wizardConfirm(in *bufio.Reader, label string, def bool) bool {
+	opts := "y/N"
+	if def {
+		opts = "Y/n"
+	}
+
+	v := strings.ToLower(wizardPrompt(in, label+" ("+opts+")", ""))
+	if v == "" {
+		return def
+	}
+	return v == "y" || v == "yes"
+}
+
+func readAllAndClose(resp *http.Response) ([]byte, error) {
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, exerr.New(exerr.TypeInternal, fmt.Sprintf("statuscode %d", resp.StatusCode)).Int("sc", resp.StatusCode).Build()
+	}
+
+	bin, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, exerr.Wrap(err, "").Build()
+	}
+	return bin, nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return "unknown error"
+	}
+	return err.Error()
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"git.blackforestbytes.com/BlackForestBytes/goext/exerr"
 	"git.blackforestbytes.com/BlackForestBytes/goext/langext"
 	"mikescher.com/kpsync/app"
@@ -13,5 +15,29 @@ func main() {
 	})
 
 	kpApp := app.NewApplication()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "exec":
+			os.Exit(kpApp.RunExec(os.Args[2:]))
+		case "status":
+			os.Exit(kpApp.RunStatus(os.Args[2:]))
+		case "pull":
+			os.Exit(kpApp.RunPull(os.Args[2:]))
+		case "push":
+			os.Exit(kpApp.RunPush(os.Args[2:]))
+		case "verify":
+			os.Exit(kpApp.RunVerify(os.Args[2:]))
+		case "init":
+			os.Exit(kpApp.RunInit(os.Args[2:]))
+		case "doctor":
+			os.Exit(kpApp.RunDoctor(os.Args[2:]))
+		case "ctl":
+			os.Exit(kpApp.RunCtl(os.Args[2:]))
+		case "config":
+			os.Exit(kpApp.RunConfig(os.Args[2:]))
+		}
+	}
+
 	kpApp.Run()
 }